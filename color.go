@@ -0,0 +1,60 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorReset  = "\033[0m"
+)
+
+// useColor is set if messages to stderr are colorized.
+var useColor = false
+
+// setColorMode sets useColor according to mode: auto, always or never. In
+// auto mode colors are used if stderr is a terminal and NO_COLOR is not set.
+func setColorMode(mode string) error {
+	switch mode {
+	case "always":
+		useColor = true
+	case "never":
+		useColor = false
+	case "auto":
+		_, noColor := os.LookupEnv("NO_COLOR")
+		fi, err := os.Stderr.Stat()
+		useColor = !noColor && err == nil && fi.Mode()&os.ModeCharDevice != 0
+	default:
+		return fmt.Errorf("unknown color mode %q, expected auto, always or never", mode)
+	}
+	return nil
+}
+
+// colorize wraps s, except trailing newlines, in color if colors are used
+// and color is not empty.
+func colorize(color, s string) string {
+	if !useColor || color == "" || s == "" {
+		return s
+	}
+	text := strings.TrimRight(s, "\n")
+	return color + text + colorReset + s[len(text):]
+}
+
+// messageColor picks color of message to stderr by its prefix: red for
+// errors and yellow for warnings. Other messages are not colorized.
+func messageColor(s string) string {
+	head, _, _ := strings.Cut(s, ":")
+	switch {
+	case strings.HasPrefix(s, "Warning:"):
+		return colorYellow
+	case strings.HasSuffix(strings.ToLower(head), "error") || strings.HasPrefix(head, "Error"):
+		return colorRed
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// profileCommands are commands taking profile names as arguments.
+var profileCommands = []string{"use", "show", "diff", "set", "delete", "rename", "promote"}
+
+const bashCompletion = `_%[1]s() {
+	local cur cmd i
+	local -a tmpl
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		-template | --template)
+			tmpl=(-template "${COMP_WORDS[i+1]}")
+			((i++))
+			;;
+		-*) ;;
+		*) [[ -z "$cmd" ]] && cmd="${COMP_WORDS[i]}" ;;
+		esac
+	done
+
+	case "$cmd" in
+	"") COMPREPLY=($(compgen -W "%[2]s" -- "$cur")) ;;
+	%[3]s) COMPREPLY=($(compgen -W "$(%[1]s "${tmpl[@]}" list 2>/dev/null | cut -f1)" -- "$cur")) ;;
+	completion) COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur")) ;;
+	import) COMPREPLY=($(compgen -f -- "$cur")) ;;
+	esac
+}
+complete -F _%[1]s %[1]s
+`
+
+const zshCompletion = `#compdef %[1]s
+
+_%[1]s() {
+	local i cmd
+	local -a tmpl profiles
+	for ((i = 2; i < CURRENT; i++)); do
+		case "${words[i]}" in
+		-template | --template)
+			tmpl=(-template "${words[i+1]}")
+			((i++))
+			;;
+		-*) ;;
+		*) [[ -z "$cmd" ]] && cmd="${words[i]}" ;;
+		esac
+	done
+
+	case "$cmd" in
+	"") compadd -- %[2]s ;;
+	%[3]s)
+		profiles=(${(f)"$(%[1]s "${tmpl[@]}" list 2>/dev/null | cut -f1)"})
+		compadd -a profiles
+		;;
+	completion) compadd -- bash zsh fish ;;
+	import) _files ;;
+	esac
+}
+
+compdef _%[1]s %[1]s
+`
+
+const fishCompletion = `complete -c %[1]s -f
+complete -c %[1]s -n __fish_use_subcommand -a "%[2]s"
+complete -c %[1]s -n "__fish_seen_subcommand_from %[3]s" -a "(%[1]s list 2>/dev/null | cut -f1)"
+complete -c %[1]s -n "__fish_seen_subcommand_from completion" -a "bash zsh fish"
+complete -c %[1]s -n "__fish_seen_subcommand_from import" -F
+`
+
+// printCompletion prints completion script for shell to STDOUT.
+func printCompletion(shell string) error {
+	tool := filepath.Base(os.Args[0])
+	cmds := strings.Join(commands, " ")
+	switch shell {
+	case "bash":
+		logToOut(bashCompletion, tool, cmds, strings.Join(profileCommands, " | "))
+	case "zsh":
+		logToOut(zshCompletion, tool, cmds, strings.Join(profileCommands, " | "))
+	case "fish":
+		logToOut(fishCompletion, tool, cmds, strings.Join(profileCommands, " "))
+	default:
+		return fmt.Errorf("unsupported shell %q, expected bash, zsh or fish", shell)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/amanofbits/tcprofiles/pkg/tcprofiles"
+)
+
+// diffProfiles prints differences between effective settings of profiles a
+// and b, each merged with default profile.
+func diffProfiles(a, b string) {
+	lines, profiles := loadTemplate()
+	selected := lookupProfiles(lines, profiles, []string{a, b})
+	lines = filterHost(lines, selected)
+	settingsA := effectiveSettings(lines, selected[0])
+	settingsB := effectiveSettings(lines, selected[1])
+
+	var keys []string
+	for k := range settingsA {
+		keys = append(keys, k)
+	}
+	for k := range settingsB {
+		if _, ok := settingsA[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	var differ, onlyA, onlyB []string
+	for _, k := range keys {
+		va, okA := settingsA[k]
+		vb, okB := settingsB[k]
+		switch {
+		case okA && okB && va != vb:
+			differ = append(differ, k)
+		case okA && !okB:
+			onlyA = append(onlyA, k)
+		case !okA && okB:
+			onlyB = append(onlyB, k)
+		}
+	}
+
+	if len(differ)+len(onlyA)+len(onlyB) == 0 {
+		logToOut("No differences between %s and %s\n", a, b)
+		return
+	}
+	if len(differ) > 0 {
+		logToOut("Different (%s -> %s):\n", a, b)
+		for _, k := range differ {
+			logToOut("\t%s: %s -> %s\n", k, tcprofiles.QuoteValue(settingsA[k]), tcprofiles.QuoteValue(settingsB[k]))
+		}
+	}
+	if len(onlyA) > 0 {
+		logToOut("Only in %s:\n", a)
+		for _, k := range onlyA {
+			logToOut("\t%s=%s\n", k, tcprofiles.QuoteValue(settingsA[k]))
+		}
+	}
+	if len(onlyB) > 0 {
+		logToOut("Only in %s:\n", b)
+		for _, k := range onlyB {
+			logToOut("\t%s=%s\n", k, tcprofiles.QuoteValue(settingsB[k]))
+		}
+	}
+}
+
+// lookupProfiles resolves aliases, and case with -ignore-case, of names of
+// profiles, exiting if any of them doesn't exist.
+func lookupProfiles(lines []tcprofiles.SectionLine, profiles, names []string) []string {
+	if *ignoreCase {
+		names = merger().FoldCase(lines, names)
+	}
+	names = tcprofiles.ExpandAliases(lines, names)
+	for _, p := range names {
+		if err := merger().CheckSelection(profiles, []string{p}); err != nil {
+			logError("%s\n", err)
+			os.Exit(exitUnknownProfile)
+		}
+	}
+	return names
+}
+
+// effectiveSettings returns settings of profile merged with default profile.
+func effectiveSettings(lines []tcprofiles.SectionLine, profile string) map[string]string {
+	settings := make(map[string]string)
+	for _, sl := range merger().Resolve(lines, []string{profile}) {
+		settings[sl.Setting.Key] = sl.Setting.Value
+	}
+	return settings
+}
+
+// diffContext is the number of unchanged lines around changes in unified
+// diff.
+const diffContext = 3
+
+// timestampRegex matches generation time put into header comment of config.
+var timestampRegex = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})`)
+
+// diffConfig prints unified diff between config file at path, or nothing if
+// it doesn't exist, and config, and reports whether they differ. Lines of
+// the comment at the top differing only in generation time are the same.
+func diffConfig(path, config string) (bool, error) {
+	oldName := path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		oldName = "/dev/null"
+	} else if err != nil {
+		return false, err
+	}
+	oldLines, newLines := splitLines(string(data)), splitLines(config)
+	for i := 0; i < len(oldLines) && i < len(newLines) && strings.HasPrefix(newLines[i], "#"); i++ {
+		if timestampRegex.ReplaceAllString(oldLines[i], "") == timestampRegex.ReplaceAllString(newLines[i], "") {
+			newLines[i] = oldLines[i]
+		}
+	}
+	if slices.Equal(oldLines, newLines) {
+		return false, nil
+	}
+	logToOut("%s", unifiedDiff(oldName, "generated", oldLines, newLines))
+	return true, nil
+}
+
+// splitLines splits text into lines without newlines.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// unifiedDiff returns differences between lines a and b in unified format,
+// with diffContext lines of context around changes.
+func unifiedDiff(nameA, nameB string, a, b []string) string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type edit struct {
+		op   byte // ' ', '-' or '+'
+		line string
+		i, j int // positions in a and b before the line
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	sb := strings.Builder{}
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(edits); {
+		if edits[start].op == ' ' {
+			start++
+			continue
+		}
+		// Hunk spans changes separated by at most 2*diffContext unchanged
+		// lines.
+		first := max(start-diffContext, 0)
+		end := start
+		for k := start; k < len(edits) && k-end <= 2*diffContext; k++ {
+			if edits[k].op != ' ' {
+				end = k
+			}
+		}
+		last := min(end+diffContext+1, len(edits))
+
+		var countA, countB int
+		for _, e := range edits[first:last] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(edits[first].i, countA), hunkRange(edits[first].j, countB))
+		for _, e := range edits[first:last] {
+			fmt.Fprintf(&sb, "%c%s\n", e.op, e.line)
+		}
+		start = last
+	}
+	return sb.String()
+}
+
+// hunkRange returns range of count lines starting after line start in
+// unified diff hunk header.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,577 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/amanofbits/tcprofiles/pkg/tcprofiles"
+)
+
+// importConfig appends settings from a flat tlp config file to the template
+// as a section of profile, creating the template if it doesn't exist.
+func importConfig(path, profile string) {
+	if *templatePath == "-" {
+		logToErr("Error: can't import into template read from STDIN\n")
+		os.Exit(exitUsage)
+	}
+	if *templateDir != "" {
+		logToErr("Error: can't import into template directory\n")
+		os.Exit(exitUsage)
+	}
+	if remoteTemplate() {
+		logToErr("Error: can't import into template read from URL\n")
+		os.Exit(exitUsage)
+	}
+	if *tmplFormat == "toml" {
+		logToErr("Error: can't import into TOML template\n")
+		os.Exit(exitUsage)
+	}
+	if !tcprofiles.ValidProfileName(profile) {
+		logToErr("Error: malformed profile name %q. Latin letters, digits, underscores, hyphens and dots only, "+
+			"starting with letter, digit or underscore\n", profile)
+		os.Exit(exitUsage)
+	}
+
+	_, profiles, err := parseTemplate()
+	exists := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logTemplateError(err)
+		os.Exit(exitTemplateError)
+	}
+	if profile != *defaultName && slices.Index(profiles, profile) >= 0 {
+		logToErr("Error: profile %s already exists in template\n", profile)
+		os.Exit(exitError)
+	}
+
+	section, count, err := readConfigFile(path)
+	if err != nil {
+		logToErr("Import error: %v\n", err)
+		os.Exit(exitError)
+	}
+
+	f, err := os.OpenFile(*templatePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		logToErr("Error opening template: %v\n", err)
+		os.Exit(exitError)
+	}
+	defer f.Close()
+
+	if !exists {
+		f.WriteString(template)
+	}
+	fmt.Fprintf(f, "\n[%s]\n%s", profile, section)
+	logInfo("Imported %d settings from %s into profile %s\n", count, path, profile)
+}
+
+// readConfigFile reads settings, and comments unless dropped, from a flat
+// key=value config file, returning them as template section body along with
+// the number of settings.
+func readConfigFile(path string) (string, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	section := strings.Builder{}
+	count := 0
+	sc := bufio.NewScanner(f)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			if !*dropComments {
+				fmt.Fprintf(&section, "%s\n", line)
+			}
+			continue
+		}
+		if !tcprofiles.IsSettingLine(line) {
+			return "", 0, fmt.Errorf("malformed line %d in %s: %s", lineNum, path, line)
+		}
+		fmt.Fprintf(&section, "%s\n", line)
+		count++
+	}
+	if err := sc.Err(); err != nil {
+		return "", 0, err
+	}
+	return section.String(), count, nil
+}
+
+// templateSection is a part of template file lines belonging to a profile:
+// lines[start:end]. The section header is at lines[header], or header is -1
+// for settings before the first header. Comment lines immediately preceding a
+// header belong to its section.
+type templateSection struct {
+	profile            string
+	header, start, end int
+}
+
+// sectionHeader returns profile name of section header line, if line is one.
+func sectionHeader(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if len(line) < 2 || line[0] != '[' || line[len(line)-1] != ']' || strings.HasPrefix(line, "[alias ") {
+		return "", false
+	}
+	return line[1 : len(line)-1], true
+}
+
+// isBlank reports whether line is empty.
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// isComment reports whether line is empty or a comment.
+func isComment(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || line[0] == '#' || line[0] == ';'
+}
+
+// directiveName returns the first word of line if it is a directive which
+// doesn't set a key, like 'raw' or 'include', or an empty string.
+func directiveName(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.Contains(line, "=") {
+		return ""
+	}
+	if fields[0] == "raw" || fields[0] == "include" {
+		return fields[0]
+	}
+	return ""
+}
+
+// isGlobalDirective reports whether line is a directive which doesn't belong
+// to the section it is in: an alias or group definition, or a raw
+// declaration.
+func isGlobalDirective(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, "[alias ") || strings.HasPrefix(line, "[group:") || directiveName(line) == "raw"
+}
+
+// splitSections splits template file lines into sections, in order.
+func splitSections(lines []string) []templateSection {
+	sections := []templateSection{{profile: *defaultName, header: -1}}
+	for i, line := range lines {
+		name, ok := sectionHeader(line)
+		if !ok {
+			continue
+		}
+		start := i
+		for start > 0 && !isBlank(lines[start-1]) && isComment(lines[start-1]) {
+			start--
+		}
+		sections[len(sections)-1].end = start
+		sections = append(sections, templateSection{profile: name, header: i, start: start})
+	}
+	sections[len(sections)-1].end = len(lines)
+	return sections
+}
+
+// readTemplateLines reads lines of template file, each ending with newline,
+// refusing templates which can't be edited. The template is expected to be
+// checked by loadTemplate separately.
+func readTemplateLines() ([]string, error) {
+	switch {
+	case *templateDir != "":
+		return nil, errors.New("can't edit template directory")
+	case *templatePath == "-":
+		return nil, errors.New("can't edit template read from STDIN")
+	case remoteTemplate():
+		return nil, errors.New("can't edit template read from URL")
+	case *tmplFormat == "toml":
+		return nil, errors.New("can't edit TOML template")
+	}
+	data, err := os.ReadFile(*templatePath)
+	if err != nil {
+		return nil, err
+	}
+	// Byte order mark is dropped, as it is by the parser.
+	lines := strings.SplitAfter(strings.TrimPrefix(string(data), "\uFEFF"), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] += "\n"
+	}
+	return lines, nil
+}
+
+// writeTemplateLines writes lines back to template file.
+func writeTemplateLines(lines []string) error {
+	return writeFileAtomic(*templatePath, []byte(strings.Join(lines, "")))
+}
+
+// parseTemplateLines parses edited template file lines, as if they were
+// written to template file, so that includes are resolved the same way.
+func parseTemplateLines(lines []string) ([]tcprofiles.SectionLine, error) {
+	f, err := os.CreateTemp(filepath.Dir(*templatePath), ".tcprofiles-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(lines, ""))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	parser := tcprofiles.Parser{AllowWhitespace: *allowTabs, ExtendedKeys: *extendedKeys, DefaultName: *defaultName}
+	return parser.ParseFile(f.Name())
+}
+
+// exitOnEditError exits with a message if editing template failed.
+func exitOnEditError(err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		logToErr("Error: template %q does not exist\n", templateName())
+		os.Exit(exitNoTemplate)
+	}
+	logTemplateError(err)
+	os.Exit(exitError)
+}
+
+// setSetting sets key to value in section of profile in template file,
+// replacing the last line setting key, or adding one after the last setting
+// of the section. The section is created if it doesn't exist.
+func setSetting(profile, key, value string) {
+	if !tcprofiles.ValidProfileName(profile) {
+		logToErr("Error: malformed profile name %q\n", profile)
+		os.Exit(exitUsage)
+	}
+	if err := checkReserved(profile); err != nil {
+		logToErr("Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	lines, err := readTemplateLines()
+	exitOnEditError(err)
+	loadTemplate()
+
+	setting := fmt.Sprintf("%s=%s\n", key, tcprofiles.QuoteValue(value))
+	lines = setKeyLine(lines, profile, key, setting)
+	exitOnEditError(writeTemplateLines(lines))
+	logInfo("Set %s in profile %s\n", key, profile)
+}
+
+// setKeyLine returns template file lines with setting line of key in section
+// of profile, replacing the last line setting key, or added after the last
+// setting of the section. The section is appended if it doesn't exist.
+func setKeyLine(lines []string, profile, key, setting string) []string {
+	sections := splitSections(lines)
+	var last *templateSection
+	keyLine := -1
+	for i := range sections {
+		if sections[i].profile != profile {
+			continue
+		}
+		last = &sections[i]
+		for j := last.start; j < last.end; j++ {
+			if settingKey(lines[j]) == key {
+				keyLine = j
+			}
+		}
+	}
+
+	switch {
+	case keyLine >= 0:
+		lines[keyLine] = setting
+	case last == nil:
+		lines = append(lines, "\n", fmt.Sprintf("[%s]\n", profile), setting)
+	default:
+		pos := last.header + 1
+		if last.header < 0 {
+			pos = last.end
+			for pos > last.start && isBlank(lines[pos-1]) {
+				pos--
+			}
+		}
+		settingFound := false
+		for j := last.end - 1; j > last.header && j >= last.start; j-- {
+			if !isComment(lines[j]) {
+				pos = j + 1
+				settingFound = true
+				break
+			}
+		}
+		if !settingFound && last.header < 0 && pos > 0 {
+			// Keep comments at the top of template apart from the setting.
+			lines = slices.Insert(lines, pos, "\n")
+			pos++
+		}
+		lines = slices.Insert(lines, pos, setting)
+	}
+	return lines
+}
+
+// settingKey returns key of setting line, or empty string if line is not a
+// setting.
+func settingKey(line string) string {
+	if isComment(line) {
+		return ""
+	}
+	if _, ok := sectionHeader(line); ok {
+		return ""
+	}
+	key, _, ok := strings.Cut(strings.TrimSpace(line), "=")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(key), "+"))
+}
+
+// fixDeprecatedKeys replaces keys deprecated by tlp with their new names in
+// setting and unset lines of template file. Included files are left as is.
+func fixDeprecatedKeys() {
+	lines, err := readTemplateLines()
+	exitOnEditError(err)
+	fixed := 0
+	for i, line := range lines {
+		key := settingKey(line)
+		if t := strings.TrimSpace(line); strings.HasPrefix(t, "!") {
+			key = strings.TrimSpace(t[1:])
+		}
+		replacement, ok := tcprofiles.ReplacementKey(key)
+		if !ok {
+			continue
+		}
+		lines[i] = strings.Replace(line, key, replacement, 1)
+		logInfo("Replaced %s with %s at line %d\n", key, replacement, i+1)
+		fixed++
+	}
+	if fixed == 0 {
+		return
+	}
+	exitOnEditError(writeTemplateLines(lines))
+	logInfo("Fixed %d deprecated keys in %s\n", fixed, *templatePath)
+}
+
+// deleteProfile removes all sections of profile from template file, along with
+// comments immediately preceding their headers.
+func deleteProfile(profile string) {
+	if profile == *defaultName {
+		logToErr("Error: default profile can't be deleted\n")
+		os.Exit(exitUsage)
+	}
+	lines, err := readTemplateLines()
+	exitOnEditError(err)
+	template, profiles := loadTemplate()
+	if slices.Index(profiles, profile) < 0 {
+		logToErr("Error: profile %s does not exist in template\n", profile)
+		os.Exit(exitUnknownProfile)
+	}
+	for _, sl := range template {
+		if sl.Extends == profile || sl.Alias == profile || sl.Group == profile {
+			logToErr("Error: profile %s is referred to by %s at line %d, remove the reference first\n",
+				profile, sl.Profile, sl.LineNum)
+			os.Exit(exitError)
+		}
+	}
+
+	sections := splitSections(lines)
+	found := false
+	for i := len(sections) - 1; i >= 0; i-- {
+		s := sections[i]
+		if s.profile != profile {
+			continue
+		}
+		// Directives of other profiles within the section are kept, an
+		// include would change its profile without the header.
+		for j := s.end - 1; j >= s.start; j-- {
+			if directiveName(lines[j]) == "include" {
+				logToErr("Error: profile %s includes a file at line %d, remove the include first\n", profile, j+1)
+				os.Exit(exitError)
+			}
+			if !isGlobalDirective(lines[j]) {
+				lines = slices.Delete(lines, j, j+1)
+			}
+		}
+		found = true
+	}
+	if !found {
+		logToErr("Error: profile %s is not defined in %s itself, but in an included file\n", profile, *templatePath)
+		os.Exit(exitError)
+	}
+	exitOnEditError(writeTemplateLines(lines))
+	logInfo("Deleted profile %s\n", profile)
+}
+
+// renameProfile renames profile from to profile to in section headers of
+// template file, and in extends directives, aliases and groups referring to
+// it.
+func renameProfile(from, to string) {
+	if from == *defaultName || to == *defaultName {
+		logToErr("Error: default profile can't be renamed\n")
+		os.Exit(exitUsage)
+	}
+	if !tcprofiles.ValidProfileName(to) {
+		logToErr("Error: malformed profile name %q. Latin letters, digits, underscores, hyphens and dots only, "+
+			"starting with letter, digit or underscore\n", to)
+		os.Exit(exitUsage)
+	}
+	if err := checkReserved(to); err != nil {
+		logToErr("Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	lines, err := readTemplateLines()
+	exitOnEditError(err)
+	template, profiles := loadTemplate()
+	if slices.Index(profiles, from) < 0 {
+		logToErr("Error: profile %s does not exist in template\n", from)
+		os.Exit(exitUnknownProfile)
+	}
+	_, isGroup := tcprofiles.Groups(template)[to]
+	if _, ok := tcprofiles.Aliases(template)[to]; ok || isGroup || slices.Index(profiles, to) >= 0 {
+		logToErr("Error: profile, alias or group %s already exists in template\n", to)
+		os.Exit(exitError)
+	}
+
+	for _, sl := range template {
+		if sl.Extends != from && sl.Alias != from && sl.Group != from {
+			continue
+		}
+		if sl.File != *templatePath {
+			logToErr("Error: profile %s is referred to in included file %s, rename it there\n", from, sl.File)
+			os.Exit(exitError)
+		}
+		if sl.Group != "" {
+			lines[sl.LineNum-1] = renameGroupMember(lines[sl.LineNum-1], from, to)
+		} else {
+			lines[sl.LineNum-1] = replaceLast(lines[sl.LineNum-1], from, to)
+		}
+	}
+	renamed := 0
+	for _, s := range splitSections(lines) {
+		if s.profile == from {
+			lines[s.header] = replaceLast(lines[s.header], from, to)
+			renamed++
+		}
+	}
+	if renamed == 0 {
+		logToErr("Error: profile %s is not defined in %s itself, but in an included file\n", from, *templatePath)
+		os.Exit(exitError)
+	}
+	exitOnEditError(writeTemplateLines(lines))
+	logInfo("Renamed profile %s to %s\n", from, to)
+}
+
+// renameGroupMember replaces member from with to in group definition line.
+func renameGroupMember(line, from, to string) string {
+	def, members, _ := strings.Cut(line, "=")
+	names := strings.Split(strings.TrimSpace(members), ",")
+	for i, name := range names {
+		if name = strings.TrimSpace(name); name == from {
+			name = to
+		}
+		names[i] = name
+	}
+	return strings.TrimSpace(def) + " = " + strings.Join(names, ", ") + "\n"
+}
+
+// promoteProfile moves settings of profile to default profile in template
+// file: values of keys set by profile replace ones in default profile, or are
+// added to it, keys removed by profile are removed from default profile.
+// Comments and the section of profile itself are kept.
+func promoteProfile(profile string) {
+	if profile == *defaultName {
+		logToErr("Error: default profile can't be promoted to itself\n")
+		os.Exit(exitUsage)
+	}
+	lines, err := readTemplateLines()
+	exitOnEditError(err)
+	template, profiles := loadTemplate()
+	if slices.Index(profiles, profile) < 0 {
+		logToErr("Error: profile %s does not exist in template\n", profile)
+		os.Exit(exitUnknownProfile)
+	}
+	// Without its settings the profile may be gone from template.
+	for _, sl := range template {
+		if sl.Extends == profile || sl.Alias == profile || sl.Group == profile {
+			logToErr("Error: profile %s is referred to by %s at line %d, remove the reference first\n",
+				profile, sl.Profile, sl.LineNum)
+			os.Exit(exitError)
+		}
+	}
+
+	var settings []tcprofiles.SectionLine
+	for _, sl := range template {
+		if sl.Profile != profile || !sl.IsSetting() {
+			continue
+		}
+		if sl.File != *templatePath {
+			logToErr("Error: profile %s has settings in included file %s, promote them there\n", profile, sl.File)
+			os.Exit(exitError)
+		}
+		settings = append(settings, sl)
+	}
+	if len(settings) == 0 {
+		logToErr("Error: profile %s has no settings to promote\n", profile)
+		os.Exit(exitError)
+	}
+
+	// Lines of plain settings are moved as written, to keep quotes,
+	// comments and variables. Other values are moved as they resolve.
+	resolved := make(map[string]string)
+	for _, sl := range merger().Resolve(template, []string{profile}) {
+		resolved[sl.Setting.Key] = sl.Setting.Value
+	}
+	texts := make([]string, len(settings))
+	for i, sl := range settings {
+		text := strings.TrimSpace(lines[sl.LineNum-1]) + "\n"
+		if sl.Append || settingKey(text) != sl.Setting.Key {
+			text = fmt.Sprintf("%s=%s\n", sl.Setting.Key, tcprofiles.QuoteValue(resolved[sl.Setting.Key]))
+		}
+		texts[i] = text
+	}
+	for i := len(settings) - 1; i >= 0; i-- {
+		lines = slices.Delete(lines, settings[i].LineNum-1, settings[i].LineNum)
+	}
+	for i, sl := range settings {
+		if sl.Unset {
+			lines = removeKeyLines(lines, *defaultName, sl.Setting.Key)
+		} else {
+			lines = setKeyLine(lines, *defaultName, sl.Setting.Key, texts[i])
+		}
+	}
+	if _, err := parseTemplateLines(lines); err != nil {
+		logToErr("Error: template would be broken by promoting profile %s, it is left as is\n", profile)
+		logTemplateError(err)
+		os.Exit(exitError)
+	}
+	exitOnEditError(writeTemplateLines(lines))
+	logInfo("Promoted %d settings of profile %s to default profile\n", len(settings), profile)
+}
+
+// removeKeyLines returns template file lines without lines setting key in
+// sections of profile.
+func removeKeyLines(lines []string, profile, key string) []string {
+	sections := splitSections(lines)
+	for i := len(sections) - 1; i >= 0; i-- {
+		if sections[i].profile != profile {
+			continue
+		}
+		for j := sections[i].end - 1; j >= sections[i].start; j-- {
+			if settingKey(lines[j]) == key {
+				lines = slices.Delete(lines, j, j+1)
+			}
+		}
+	}
+	return lines
+}
+
+// replaceLast replaces the last occurrence of old in s with new.
+func replaceLast(s, old, new string) string {
+	i := strings.LastIndex(s, old)
+	if i < 0 {
+		return s
+	}
+	return s[:i] + new + s[i+len(old):]
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/amanofbits/tcprofiles/pkg/tcprofiles"
+)
+
+// formatTemplate rewrites template file in canonical form, see formatLines.
+// With check set the file is left as is, and the tool exits with non-zero
+// code if it is not formatted.
+func formatTemplate(check bool) {
+	lines, err := readTemplateLines()
+	exitOnEditError(err)
+	loadTemplate()
+
+	formatted := formatLines(lines, *sortKeys)
+	if slices.Equal(lines, formatted) {
+		logInfo("Template %s is already formatted\n", *templatePath)
+		return
+	}
+	if check {
+		logToErr("Error: template %s is not formatted, run fmt to fix it\n", *templatePath)
+		os.Exit(exitError)
+	}
+	same, err := sameMeaning(lines, formatted)
+	exitOnEditError(err)
+	if !same {
+		logToErr("Error: formatting would change the meaning of template %s, left as is\n", *templatePath)
+		os.Exit(exitError)
+	}
+	exitOnEditError(writeTemplateLines(formatted))
+	logInfo("Formatted template %s\n", *templatePath)
+}
+
+// formatLines returns template file lines in canonical form: without
+// indentation and trailing whitespace, with '=' between key and value, ' = '
+// in extends, host and group directives, a single blank line before each
+// section and no blank lines after section headers. Comments are kept,
+// sections stay in order. With sortKeys, settings in each group of lines not
+// separated by blank lines or directives are sorted by key, along with
+// comments preceding them. Formatting formatted lines doesn't change them.
+func formatLines(lines []string, sortKeys bool) []string {
+	canonical := make([]string, 0, len(lines))
+	rawKeys := make(map[string]bool)
+	for _, line := range lines {
+		canonical = append(canonical, formatLine(line, rawKeys))
+	}
+	if sortKeys {
+		sortSettings(canonical)
+	}
+
+	var out []string
+	for _, line := range canonical {
+		if line == "\n" {
+			if len(out) > 0 && out[len(out)-1] != "\n" {
+				if _, ok := sectionHeader(out[len(out)-1]); !ok {
+					out = append(out, line)
+				}
+			}
+			continue
+		}
+		if _, ok := sectionHeader(line); ok {
+			start := len(out)
+			for start > 0 && out[start-1] != "\n" && isComment(out[start-1]) {
+				start--
+			}
+			if start > 0 && out[start-1] != "\n" {
+				out = slices.Insert(out, start, "\n")
+			}
+		}
+		out = append(out, line)
+	}
+	for len(out) > 0 && out[len(out)-1] == "\n" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// formatLine returns canonical form of a single template line, ending with
+// newline. Keys of raw directives are added to rawKeys, their values are kept
+// as is.
+func formatLine(line string, rawKeys map[string]bool) string {
+	untrimmed := strings.TrimRight(line, "\r\n")
+	t := strings.TrimSpace(line)
+	if t == "" || t[0] == '#' || t[0] == ';' {
+		return t + "\n"
+	}
+	if name, ok := sectionHeader(t); ok {
+		return "[" + strings.TrimSpace(name) + "]\n"
+	}
+	if strings.HasPrefix(t, "[alias ") && strings.HasSuffix(t, "]") {
+		alias, target, ok := strings.Cut(t[len("[alias "):len(t)-1], "=")
+		if ok {
+			return "[alias " + strings.TrimSpace(alias) + "=" + strings.TrimSpace(target) + "]\n"
+		}
+		return t + "\n"
+	}
+
+	if strings.HasPrefix(t, "[group:") {
+		def, members, ok := strings.Cut(t, "=")
+		if !ok {
+			return t + "\n"
+		}
+		names := strings.Split(members, ",")
+		for i := range names {
+			names[i] = strings.TrimSpace(names[i])
+		}
+		group := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(def), "[group:"), "]"))
+		return "[group:" + group + "] = " + strings.Join(names, ", ") + "\n"
+	}
+
+	name := t[:len(t)-len(strings.TrimLeftFunc(t, isKeyRune))]
+	rest := t[len(name):]
+	switch {
+	case name == "":
+		return t + "\n"
+	case (name == "include" || name == "raw" || name == "enable") && rest != "" && unicode.IsSpace(rune(rest[0])):
+		if name != "raw" {
+			return name + " " + strings.TrimSpace(rest) + "\n"
+		}
+		keys := strings.FieldsFunc(rest, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		for _, key := range keys {
+			rawKeys[key] = true
+		}
+		return "raw " + strings.Join(keys, ", ") + "\n"
+	case name == "host" || name == "extends":
+		value, ok := strings.CutPrefix(strings.TrimSpace(rest), "=")
+		if !ok {
+			break
+		}
+		if name == "host" {
+			hosts := strings.Split(value, ",")
+			for i := range hosts {
+				hosts[i] = strings.TrimSpace(hosts[i])
+			}
+			value = strings.Join(hosts, ", ")
+		}
+		return name + " = " + strings.TrimSpace(value) + "\n"
+	}
+
+	op := "="
+	switch trimmed := strings.TrimLeft(rest, " \t"); {
+	case strings.HasPrefix(trimmed, "+="):
+		op, rest = "+=", trimmed
+	case strings.HasPrefix(trimmed, "="):
+		rest = trimmed
+	case rest != "" && unicode.IsSpace(rune(rest[0])):
+		// Whitespace separated 'KEY<tab>VALUE'.
+		return name + "=" + strings.TrimSpace(rest) + "\n"
+	default:
+		return t + "\n"
+	}
+	if i := strings.Index(untrimmed, "="); rawKeys[name] && op == "=" {
+		return name + "=" + untrimmed[i+1:] + "\n"
+	}
+	return name + op + strings.TrimSpace(rest[len(op):]) + "\n"
+}
+
+// isKeyRune reports whether r can be a part of setting key.
+func isKeyRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || *extendedKeys && (r == '-' || r == '.')
+}
+
+// formattedKey returns key of canonical setting or unset line, or empty
+// string if line is neither.
+func formattedKey(line string) string {
+	if strings.HasPrefix(line, "!") {
+		return strings.TrimSpace(line[1:])
+	}
+	if strings.HasPrefix(line, "include ") || strings.HasPrefix(line, "raw ") || strings.HasPrefix(line, "enable ") ||
+		strings.HasPrefix(line, "host = ") || strings.HasPrefix(line, "extends = ") {
+		return ""
+	}
+	return settingKey(line)
+}
+
+// sortSettings sorts settings of canonical lines by key, in place, in each
+// group of consecutive setting and comment lines. Comments move along with
+// the setting following them.
+func sortSettings(lines []string) {
+	type item struct {
+		key   string
+		lines []string
+	}
+	for i := 0; i < len(lines); {
+		var items []item
+		j := i
+		for {
+			k := j
+			for k < len(lines) && lines[k] != "\n" && isComment(lines[k]) {
+				k++
+			}
+			if k == len(lines) || formattedKey(lines[k]) == "" {
+				break
+			}
+			items = append(items, item{formattedKey(lines[k]), lines[j : k+1]})
+			j = k + 1
+		}
+		if len(items) < 2 {
+			i = max(j, i+1)
+			continue
+		}
+		slices.SortStableFunc(items, func(a, b item) int {
+			return strings.Compare(a.key, b.key)
+		})
+		var sorted []string
+		for _, it := range items {
+			sorted = append(sorted, it.lines...)
+		}
+		copy(lines[i:j], sorted)
+		i = j
+	}
+}
+
+// sameMeaning reports whether template file lines before and after
+// formatting parse to the same profiles and settings, regardless of the
+// order of different keys in a profile. Comments are not compared, as the
+// comment of a section header goes to whichever setting is the first.
+func sameMeaning(before, after []string) (bool, error) {
+	parse := func(lines []string) ([]tcprofiles.SectionLine, error) {
+		parsed, err := parseTemplateLines(lines)
+		if err != nil {
+			return nil, err
+		}
+		for i := range parsed {
+			parsed[i].File, parsed[i].LineNum, parsed[i].Comment = "", 0, ""
+		}
+		slices.SortStableFunc(parsed, func(a, b tcprofiles.SectionLine) int {
+			if c := strings.Compare(a.Profile, b.Profile); c != 0 {
+				return c
+			}
+			return strings.Compare(a.Setting.Key, b.Setting.Key)
+		})
+		return parsed, nil
+	}
+	b, err := parse(before)
+	if err != nil {
+		return false, err
+	}
+	a, err := parse(after)
+	if err != nil {
+		return false, nil
+	}
+	return slices.Equal(b, a), nil
+}
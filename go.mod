@@ -1,3 +1,5 @@
 module github.com/amanofbits/tcprofiles
 
 go 1.22.3
+
+require github.com/pelletier/go-toml/v2 v2.3.1
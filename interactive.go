@@ -0,0 +1,72 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// pickProfiles lists profiles of template to stderr and reads selection of
+// them by number from STDIN, asking again until the selection is valid.
+func pickProfiles() ([]string, error) {
+	if *templatePath == "-" && *templateDir == "" {
+		return nil, errors.New("-interactive can't be used with template read from STDIN")
+	}
+	_, profiles := loadTemplate()
+
+	logToErr("Profiles found in template:\n")
+	for i, p := range profiles {
+		logToErr("\t%d) %s\n", i+1, p)
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		logToErr("Select profiles by number, separated by spaces: ")
+		line, err := in.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			if errors.Is(err, io.EOF) {
+				logToErr("\n")
+				return nil, errNoProfileSelected
+			}
+			continue
+		}
+
+		selected, selErr := parseSelection(line, profiles)
+		if selErr == nil {
+			return selected, nil
+		}
+		logError("%v\n", selErr)
+		if errors.Is(err, io.EOF) {
+			return nil, errNoProfileSelected
+		}
+	}
+}
+
+// parseSelection maps space or comma separated 1-based numbers in line to
+// profiles.
+func parseSelection(line string, profiles []string) ([]string, error) {
+	var selected []string
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	for _, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 || n > len(profiles) {
+			return nil, fmt.Errorf("no profile with number %s", f)
+		}
+		selected = append(selected, profiles[n-1])
+	}
+	if err := merger().CheckSelection(profiles, selected); err != nil {
+		return nil, err
+	}
+	return selected, nil
+}
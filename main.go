@@ -4,29 +4,74 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"regexp"
+	"runtime"
+	"runtime/debug"
 	"slices"
 	"strings"
+	"syscall"
+	"time"
 	"unicode"
+
+	"github.com/amanofbits/tcprofiles/pkg/tcprofiles"
 )
 
 const (
-	templateFile       = "./tctemplate.txt"
-	defaultProfileName = "default"
-	template           = `# Profiles are defined as ini/toml sections, e.g. [profile_name]
+	templateFile = "./tctemplate.txt"
+	template     = `# Profiles are defined as ini/toml sections, e.g. [profile_name]
+# Profile names can contain Latin letters, digits, underscores, hyphens and dots, e.g. [work-ac]
 # Values before any profile defined belong to default profile, they will be used if not overridden in specific profile.
-# Lines starting with '#' are comments (won't go into produced file)
+# Lines starting with '#' or ';' are comments (won't go into produced file)
+# Text after ' #' or ' ;' at the end of a setting line is a comment too, unless it is quoted
+# Values can be quoted with "" or '', quotes are added to produced file only when needed
 #
 # Default profile is usually a baseline for a day-to-day device usage.
 # Specific profiles exist to override defaults for specific situations
 # (like when "AC" is actually a powerbank, and needs to be treated like battery)
 #
+# A line like '!KEY' in a profile removes KEY set by previously applied profiles,
+# so it doesn't appear in the output at all. Profiles applied later can set it again.
+#
+# 'KEY+=entries' appends space-separated entries to KEY set by previously applied
+# profiles, instead of replacing its value. Entries already in the list are skipped.
+#
+# Values can refer to environment variables as ${VAR} or ${VAR:-default}.
+# ${profile} is replaced with the name of the profile, ${hostname} with the
+# host name.
+#
+# A setting commented out like '#KEY=VALUE' can be turned on in a profile with
+# 'enable KEY' line, which takes the value of the last such comment.
+#
+# After a 'raw KEY[, KEY...]' line, values of these keys are taken exactly as
+# written after '=', including whitespace, quotes and comments.
+#
+# Other template files can be included with 'include <path>', relative paths are
+# resolved against the directory of the including file.
+#
+# Short names for profiles can be defined anywhere with lines like
+# [alias ac=ac_powerbank_aggressive], and used instead of profile names.
+#
+# A line like '[group:evening] = relax, low_power' defines a group, selecting
+# it selects its members, in order.
+#
+# A profile can inherit settings of another one by having 'extends = <profile>'
+# as its first line. Own settings of the profile override inherited ones.
+#
+# A profile with 'host = <hostname>[, <hostname>...]' line applies only on these
+# hosts, on others its settings are skipped. This allows to share a template
+# between machines.
+#
+# A comment starting with 'description:' in a profile describes it for the list
+# command, it doesn't go into produced file.
+#
 # You can have specific profiles for AC and BAT and combine them in different ways,
 # tlp documentation can be fount at https://linrunner.de/tlp/settings/
 #
@@ -41,16 +86,113 @@ const (
 `
 )
 
+// defaultHeader is the comment at the top of produced config,
+// noTimestampHeader is used instead with -no-timestamp.
+const (
+	defaultHeader     = "Generated by tcprofiles from: {profiles} at {time}"
+	noTimestampHeader = "Generated by tcprofiles from: {profiles}"
+)
+
+// templateEnv is the environment variable with template path used if
+// -template is not given.
+const templateEnv = "TCPROFILES_TEMPLATE"
+
+// fetchTimeout limits fetching template from an HTTP(S) URL.
+const fetchTimeout = 30 * time.Second
+
+// Exit codes.
+const (
+	exitError          = 1 // other errors, e.g. failed output
+	exitUsage          = 2 // bad command line arguments
+	exitNoTemplate     = 3 // template does not exist
+	exitTemplateError  = 4 // template can't be parsed
+	exitUnknownProfile = 5 // selected profile does not exist or can't be selected
+)
+
 var (
 	errNoArguments       = errors.New("no arguments specified")
 	errNoProfileSelected = errors.New("no profile[s] selected")
 )
 
+// commands are all commands supported by the tool.
+var commands = []string{"template", "list", "keys", "redundant", "validate", "import", "set", "delete", "rename", "promote", "fmt", "use", "show", "dump-all", "diff", "completion", "version"}
+
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
+var (
+	templatePath = flag.String("template", templateFile, "")
+	templateDir  = flag.String("template-dir", "", "")
+	outputPath   = flag.String("o", "", "")
+	annotate     = flag.Bool("annotate", false, "")
+	strict       = flag.Bool("strict", false, "")
+	dryRun       = flag.Bool("dry-run", false, "")
+	dropComments = flag.Bool("drop-comments", false, "")
+	apply        = flag.Bool("apply", false, "")
+	auto         = flag.String("auto", "", "")
+	format       = flag.String("format", "ini", "")
+	backup       = flag.Bool("backup", false, "")
+	sortKeys     = flag.Bool("sort", false, "")
+	checkKeys    = flag.Bool("check-keys", false, "")
+	checkValues  = flag.Bool("check-values", false, "")
+	keepComments = flag.Bool("keep-comments", false, "")
+	allowUnset   = flag.Bool("allow-unset-env", false, "")
+	ignoreCase   = flag.Bool("ignore-case", false, "")
+	quiet        = flag.Bool("quiet", false, "")
+	quietShort   = flag.Bool("q", false, "")
+	verbose      = flag.Bool("v", false, "")
+	veryVerbose  = flag.Bool("vv", false, "")
+	colorMode    = flag.String("color", "auto", "")
+	interactive  = flag.Bool("interactive", false, "")
+	header       = flag.String("header", defaultHeader, "")
+	noHeader     = flag.Bool("no-header", false, "")
+	noTimestamp  = flag.Bool("no-timestamp", false, "")
+	explain      = flag.Bool("explain", false, "")
+	profilesFile = flag.String("profiles-file", "", "")
+	profileList  = flag.String("profiles", "", "")
+	allowTabs    = flag.Bool("allow-tabs", false, "")
+	checkFormat  = flag.Bool("check", false, "")
+	split        = flag.Bool("split", false, "")
+	outDir       = flag.String("out-dir", ".", "")
+	watch        = flag.Bool("watch", false, "")
+	defaultName  = flag.String("default-name", tcprofiles.DefaultProfile, "")
+	force        = flag.Bool("force", false, "")
+	yes          = flag.Bool("yes", false, "")
+	countSummary = flag.Bool("count", false, "")
+	extendedKeys = flag.Bool("allow-extended-keys", false, "")
+	mergeOrder   = flag.String("merge-strategy", "selection-order", "")
+	diffPath     = flag.String("diff", "", "")
+	noDefault    = flag.Bool("no-default", false, "")
+	fixKeys      = flag.Bool("fix", false, "")
+	preamble     = flag.String("preamble", "", "")
+	toStdout     = flag.Bool("stdout", false, "")
+	normalize    = flag.Bool("normalize-lists", false, "")
+	lintDefaults = flag.Bool("lint-unused-defaults", false, "")
+	preWrite     = flag.String("pre-write", "", "")
+	tmplFormat   = flag.String("template-format", "ini", "")
+	maxLineLen   = flag.Int("max-line-length", 0, "")
+)
+
+// verbosity is the level of logged details: 0 logs errors and warnings only,
+// 1 adds informational messages, 2 adds resolution of each setting.
+var verbosity = 0
+
+// allErrors makes template parsing report all malformed lines instead of the
+// first one, for 'validate'.
+var allErrors = false
+
+// preambleText is the content of -preamble file, put into config after the
+// header comment.
+var preambleText = ""
+
 func main() {
 	selected, err := parseInput()
 	if err != nil {
+		if logJSONError(err, "") {
+			os.Exit(exitUsage)
+		}
 		if !errors.Is(err, errNoArguments) {
-			logToErr("%v\n\n", err)
+			logError("%v\n\n", err)
 		}
 		if errors.Is(err, errNoArguments) || errors.Is(err, errNoProfileSelected) {
 			_, profiles, err := parseTemplate()
@@ -61,54 +203,376 @@ func main() {
 			}
 		}
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	template, profiles, err := parseTemplate()
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
-			logToErr("Error: template file does not exist. Please create one\n")
-			printUsage()
-			os.Exit(1)
+			var fe fetchError
+			if errors.As(err, &fe) {
+				if !logJSONError(err, templateName()) {
+					logToErr("Error: %v\n", err)
+				}
+			} else if !logJSONError(errors.New("template does not exist"), templateName()) {
+				logToErr("Error: template %q does not exist. Please create one\n", templateName())
+				printUsage()
+			}
+			os.Exit(exitNoTemplate)
 		}
-		logToErr("Template error: %v\n", err)
-		os.Exit(1)
+		logTemplateError(err)
+		os.Exit(exitTemplateError)
 	}
 
-	if err = matchSelected(selected, profiles); err != nil {
-		logToErr("%s\n", err)
-		logToErr("Profiles found in template: %s\n", strings.Join(profiles, ", "))
-		os.Exit(1)
+	for _, p := range profiles {
+		if checkReserved(p) == nil {
+			continue
+		}
+		logWarning("profile %s has a command name and can't be selected, rename it\n", p)
 	}
 
-	logToErr("Profiles selected: %s;\n", strings.Join(selected, ", "))
-	logToErr("Profiles found in template: %s\n", strings.Join(profiles, ", "))
+	if *ignoreCase {
+		selected = merger().FoldCase(template, selected)
+	}
+	selected = tcprofiles.ExpandAliases(template, tcprofiles.ExpandGroups(template, selected))
+	if selected, err = tcprofiles.ExpandPatterns(profiles, selected); err == nil {
+		err = merger().CheckSelection(profiles, selected)
+	}
+	if err == nil && *noDefault && slices.Index(selected, *defaultName) >= 0 {
+		err = errors.New("default profile can't be selected with -no-default")
+	}
+	if err != nil {
+		if !logJSONError(err, "") {
+			logError("%s\n", err)
+			logToErr("Profiles found in template: %s\n", strings.Join(profiles, ", "))
+		}
+		os.Exit(exitUnknownProfile)
+	}
+	if *mergeOrder == "template-order" {
+		selected = merger().TemplateOrder(template, selected)
+	}
 
-	config := strings.Builder{}
-	fillConfig(&config, template, selected)
+	template = filterHost(template, selected)
+	if *noDefault {
+		template = dropDefault(template)
+	}
+
+	logInfo("Profiles selected: %s;\n", colorize(colorGreen, strings.Join(selected, ", ")))
+	logInfo("Profiles found in template: %s\n", strings.Join(profiles, ", "))
+
+	if *dryRun {
+		printDryRun(template, selected)
+		return
+	}
+
+	if *apply && os.Geteuid() != 0 {
+		logToErr("Error: -apply requires root privileges to run 'tlp start', try running with sudo\n")
+		os.Exit(exitError)
+	}
+
+	if *split {
+		ext := ".conf"
+		switch *format {
+		case "json":
+			ext = ".json"
+		case "env":
+			ext = ".sh"
+		}
+		configs := make([]string, len(selected))
+		counts := make([]int, len(selected))
+		for i, p := range selected {
+			configs[i], counts[i] = buildConfig(template, []string{p})
+		}
+		for _, config := range configs {
+			exitOnOutputError(runPreWrite(config))
+		}
+		for i, p := range selected {
+			path := filepath.Join(*outDir, p+ext)
+			exitOnOutputError(writeConfig(path, configs[i]))
+			logInfo("Written %d bytes (%d settings) to %s\n", len(configs[i]), counts[i], path)
+		}
+	} else if config, count := buildConfig(template, selected); *diffPath != "" {
+		differ, err := diffConfig(*diffPath, config)
+		exitOnOutputError(err)
+		if differ {
+			os.Exit(exitError)
+		}
+		logInfo("Config %s is up to date\n", *diffPath)
+	} else if err := runPreWrite(config); err != nil {
+		exitOnOutputError(err)
+	} else if *outputPath != "" {
+		exitOnOutputError(writeConfig(*outputPath, config))
+		logInfo("Written %d bytes (%d settings) to %s\n", len(config), count, *outputPath)
+		if *toStdout {
+			logToOut("%s\n", config)
+		}
+	} else {
+		logInfo("Output:\n")
 
-	logToErr("Output:\n")
+		logToOut("%s\n", config)
+	}
 
-	logToOut("%s\n", config.String())
+	if *apply {
+		if err = applyConfig(); err != nil {
+			if !logJSONError(fmt.Errorf("applying config: %v", err), "") {
+				logToErr("Error applying config: %v\n", err)
+			}
+			os.Exit(exitError)
+		}
+	}
 }
 
-func matchSelected(selected, profiles []string) error {
+// buildConfig returns config of merged settings of selected profiles in
+// output format, and the number of settings in it. Config without settings
+// is a warning, as deploying it would drop all tlp tuning.
+func buildConfig(template []tcprofiles.SectionLine, selected []string) (string, int) {
+	config := strings.Builder{}
+	var count int
+	if *format == "json" {
+		var err error
+		count, err = fillJSON(&config, template, selected)
+		exitOnOutputError(err)
+	} else {
+		count = fillConfig(&config, template, selected)
+	}
+	if count == 0 {
+		logWarning("no settings in output for %s, the config would be empty\n", strings.Join(selected, ", "))
+	}
+	if *countSummary && !*quiet && !*quietShort {
+		logSummary(template, selected)
+	}
+	return config.String(), count
+}
+
+// logSummary logs a line with the number of output settings of selected
+// profiles, how many of them come from each profile, and how many settings
+// were replaced by later profiles. Appending to or removing a setting doesn't
+// count as replacing it.
+func logSummary(template []tcprofiles.SectionLine, selected []string) {
+	order := []string{*defaultName}
+	if *noDefault {
+		order = nil
+	}
 	for _, p := range selected {
-		if slices.Index(profiles, p) < 0 {
-			return fmt.Errorf("profile does not exist in template: %s", p)
+		if slices.Index(order, p) < 0 {
+			order = append(order, p)
+		}
+	}
+	resolved := merger().Resolve(template, selected)
+	counts := make(map[string]int)
+	for _, sl := range resolved {
+		if slices.Index(order, sl.Profile) < 0 {
+			order = append(order, sl.Profile)
+		}
+		counts[sl.Profile]++
+	}
+
+	overridden := 0
+	last := make(map[string]tcprofiles.SectionLine)
+	for _, sl := range merger().Contributions(template, selected) {
+		if prev, ok := last[sl.Setting.Key]; ok && !prev.Unset && !sl.Unset && !sl.Append {
+			overridden++
+		}
+		last[sl.Setting.Key] = sl
+	}
+
+	parts := make([]string, 0, len(order))
+	for _, p := range order {
+		parts = append(parts, fmt.Sprintf("%s %d", p, counts[p]))
+	}
+	logToErr("Settings: %d (%s), %d overridden\n", len(resolved), strings.Join(parts, ", "), overridden)
+}
+
+// exitOnOutputError exits with a message if producing output failed.
+func exitOnOutputError(err error) {
+	if err == nil {
+		return
+	}
+	if !logJSONError(err, "") {
+		logToErr("Output error: %v\n", err)
+	}
+	os.Exit(exitError)
+}
+
+// jsonError is an error logged as JSON object with -format json.
+type jsonError struct {
+	Error string `json:"error"`
+	Line  int    `json:"line,omitempty"`
+	File  string `json:"file,omitempty"`
+}
+
+// logJSONError logs err to STDERR as JSON object, with line and file of
+// template if err has them, or file if it is not empty, and reports whether
+// it did. Errors are only logged as JSON with -format json.
+func logJSONError(err error, file string) bool {
+	if *format != "json" {
+		return false
+	}
+	je := jsonError{Error: err.Error(), File: file}
+	var le *tcprofiles.LineError
+	if errors.As(err, &le) {
+		je.Line, je.File = le.Line, le.File
+	}
+	data, _ := json.Marshal(je)
+	fmt.Fprintf(os.Stderr, "%s\n", data)
+	return true
+}
+
+// applyConfig runs 'tlp start', streaming its output to STDERR to keep
+// STDOUT for the config only.
+func applyConfig() error {
+	logInfo("Running tlp start\n")
+	cmd := exec.Command("tlp", "start")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runPreWrite runs -pre-write command, if any, with config on STDIN, and
+// reports its failure. The command is run by sh, its output goes to STDERR
+// to keep STDOUT for the config only.
+func runPreWrite(config string) error {
+	if *preWrite == "" {
+		return nil
+	}
+	logInfo("Running %s\n", *preWrite)
+	cmd := exec.Command("sh", "-c", *preWrite)
+	cmd.Stdin = strings.NewReader(config)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pre-write command %q failed (%v), nothing is written", *preWrite, err)
+	}
+	return nil
+}
+
+// backupFile copies file at path, if it exists, to path with .bak suffix.
+func backupFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("backup of %q failed: %v", path, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("backup of %q failed: %v", path, err)
+	}
+	if err = os.WriteFile(path+".bak", data, fi.Mode().Perm()); err != nil {
+		return fmt.Errorf("backup of %q failed: %v", path, err)
+	}
+	logInfo("Backed up %s to %s.bak\n", path, path)
+	return nil
+}
+
+// writeConfig writes config to path, creating parent directories if needed.
+// Existing file is backed up first if requested.
+func writeConfig(path, config string) error {
+	if *backup {
+		if err := backupFile(path); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("permission denied creating directory for %q, try running with sudo", path)
+		}
+		return err
+	}
+	if err := writeFileAtomic(path, []byte(config)); err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("permission denied writing %q, try running with sudo", path)
 		}
+		return err
 	}
 	return nil
 }
 
+// writeFileAtomic writes data to a temporary file in the directory of path
+// and renames it to path, so that path never has partially written content.
+// Permissions and ownership of existing file at path are kept, new files are
+// created with 0644 permissions. Symlinks at path are followed.
+func writeFileAtomic(path string, data []byte) error {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			// Changing ownership requires root, keep the owner of temporary
+			// file otherwise.
+			os.Chown(tmp, int(st.Uid), int(st.Gid))
+		}
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func logToErr(msg string, args ...any) {
-	s := fmt.Sprintf(msg, args...)
-	if len(s) != 0 {
-		sr := []rune(s)
-		sr[0] = unicode.ToUpper(sr[0])
-		s = string(sr)
+	s := capitalize(fmt.Sprintf(msg, args...))
+	fmt.Fprintf(os.Stderr, "%s", colorize(messageColor(s), s))
+}
+
+// logError logs error message to stderr, colorized as error regardless of
+// its prefix.
+func logError(msg string, args ...any) {
+	s := capitalize(fmt.Sprintf(msg, args...))
+	fmt.Fprintf(os.Stderr, "%s", colorize(colorRed, s))
+}
+
+func capitalize(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	sr := []rune(s)
+	sr[0] = unicode.ToUpper(sr[0])
+	return string(sr)
+}
+
+// logWarning logs warning to stderr, or exits with it as an error with
+// -strict.
+func logWarning(msg string, args ...any) {
+	if *strict {
+		logError("Error: "+msg, args...)
+		os.Exit(exitError)
+	}
+	logToErr("Warning: "+msg, args...)
+}
+
+// logInfo logs informational message to stderr with -v and above.
+func logInfo(msg string, args ...any) {
+	if verbosity >= 1 {
+		logToErr(msg, args...)
+	}
+}
+
+// logDebug logs details of setting resolution to stderr with -vv.
+func logDebug(msg string, args ...any) {
+	if verbosity >= 2 {
+		logToErr(msg, args...)
 	}
-	fmt.Fprintf(os.Stderr, "%s", s)
 }
 
 func logToOut(msg string, args ...any) {
@@ -117,6 +581,10 @@ func logToOut(msg string, args ...any) {
 
 func printUsage() {
 	tool := filepath.Base(os.Args[0])
+	tmpl := filepath.Base(templateFile)
+	if *templatePath != templateFile {
+		tmpl = *templatePath
+	}
 	logToErr(`
 Usage:
 	This tool allows to create tlp config text using profiles from a template.
@@ -136,125 +604,637 @@ Usage:
 	You can specify one or more profiles, they will be applied one by one left
 	to right, duplicate settings from last overrides such from first.
 
+	Profiles can be selected with glob patterns too, e.g. 'work_*', matching
+	profiles are applied in sorted order.
+
 	You can specify 'default' only as the single, or the first (which is
 	unnecessary) profile.
-`, filepath.Base(templateFile), tool, tool, tool, tool)
+
+	'@NAME' selects the profile named by the value of environment variable
+	NAME, e.g. 'use @TLP_PROFILE'.
+
+Other commands:
+	./%s list
+		Print profiles found in template with number of settings in each,
+		and their descriptions.
+	./%s keys
+		Print keys set in template, sorted, with profiles setting each.
+	./%s redundant
+		Print keys set to the same value by every profile setting them,
+		with the value and the profiles, as candidates for default.
+	./%s validate
+		Check template for errors without producing output, reporting
+		all malformed lines. Exits with non-zero code if template is
+		invalid.
+	./%s import <config_file> [<profile>]
+		Append settings from existing tlp config file to template as a new
+		profile section ('default' if not specified). Creates template if
+		it doesn't exist.
+	./%s set <profile> KEY=VALUE
+		Set KEY in profile section of template, replacing its existing
+		value, or adding it after the last setting of the section. The
+		section is appended to template if it doesn't exist.
+	./%s delete <profile>
+		Remove profile section, along with comments preceding its header,
+		from template. Alias and group definitions and raw declarations
+		in the section are kept. Default profile can't be deleted.
+	./%s rename <profile> <new_name>
+		Rename profile in template, updating 'extends' directives and
+		aliases referring to it.
+	./%s promote <profile>
+		Move settings of profile to default profile in template, replacing
+		values of the same keys there. Keys removed by profile are removed
+		from default profile.
+	./%s fmt
+		Rewrite template in canonical form: '=' without spaces between
+		key and value, no indentation or trailing whitespace, a single
+		blank line before each section. Comments are kept, sections stay
+		in order. With -sort, settings are sorted by key within groups of
+		lines separated by blank lines.
+	./%s show <profile>
+		Print settings of profile merged with default profile, without
+		header or other messages.
+	./%s dump-all
+		Print settings of each profile merged with default profile, under
+		a '### <profile> ###' banner.
+	./%s diff <profile1> <profile2>
+		Print settings which differ between two profiles, each merged with
+		default profile.
+	./%s completion bash|zsh|fish
+		Print shell completion script, e.g.
+			source <(./%s completion bash)
+	./%s version
+		Print version of the tool.
+
+Options:
+	-template <path>
+		Use template file at <path> instead of '%s'.
+		Works with both 'template' and 'use' commands. Use '-' to read
+		template from STDIN ('template' command prints it to STDOUT).
+		An http:// or https:// URL fetches template for reading only.
+		If -template is not given, template path is taken from
+		TCPROFILES_TEMPLATE environment variable, if it is set.
+	-template-format ini|toml
+		Format of template. 'toml' reads a TOML file, with tables as
+		profiles. Default is 'ini'.
+	-default-name <name>
+		Treat profile <name> as the default one, which is always applied
+		first and gets settings before the first section of template,
+		instead of 'default'.
+	-force
+		Make 'template' overwrite existing template file, after
+		confirmation on STDIN.
+	-yes
+		Overwrite with -force without asking for confirmation.
+	-template-dir <dir>
+		Read template from all *.txt files in <dir>, in order of their
+		names, instead of template file. Sections with the same name are
+		combined, settings from later files override earlier ones.
+	-o <path>
+		Write output of 'use' to <path> instead of STDOUT, creating
+		parent directories if needed.
+	-no-default
+		Don't apply default profile in 'use', producing settings of
+		selected profiles only. Default profile can't be selected then.
+	-diff <path>
+		Print unified diff between config file at <path> and output of
+		'use' instead of the output, exiting with non-zero code if they
+		differ. Generation time in header comment is ignored.
+	-pre-write <command>
+		Run <command> with output of 'use' on STDIN before writing it,
+		e.g. a validator. Nothing is written if it fails. With -split it
+		runs for each file.
+	-stdout
+		Write output of 'use' to STDOUT even when -o is passed, where it
+		goes by default. Can't be used with -split.
+	-split
+		Write a separate file for each profile selected for 'use', with
+		settings of default profile merged with that profile only, named
+		'<profile>.conf' ('<profile>.json' or '<profile>.sh' with
+		-format json or env).
+	-out-dir <dir>
+		Write files of -split to <dir> instead of the current directory,
+		creating it if needed.
+	-backup
+		Copy file at -o path, or each file of -split, if it exists, to
+		'<path>.bak' before writing.
+		Nothing is written if backup fails.
+	-format ini|json|env
+		Output format of 'use'. 'json' produces an object of settings with
+		sorted keys, and errors are logged as objects like
+		{"error":"...","line":3,"file":"..."}. 'env' produces lines like
+		export KEY='VALUE' for shell scripts. Default is 'ini'.
+	-merge-strategy selection-order|template-order
+		Order in which profiles selected for 'use' are applied: as they
+		are selected, or as they appear in template, so that later
+		defined profiles win. Default is 'selection-order'.
+	-sort
+		Sort settings in output of 'use', or in template with 'fmt', by
+		key.
+	-check
+		Make 'fmt' only check that template is formatted, exiting with
+		non-zero code if it is not.
+	-header <text>
+		Use <text> as the comment at the top of output of 'use' instead
+		of '%s'.
+		{profiles} is replaced with selected profiles, {time} with the
+		current time. Lines are commented with '#'.
+	-preamble <path>
+		Put content of file at <path>, comments only, into output of
+		'use' after the comment at the top, e.g. license or notes.
+	-no-header
+		Don't put a comment at the top of output of 'use'.
+	-no-timestamp
+		Leave generation time out of the default comment at the top of
+		output of 'use', to get the same output for the same template.
+	-normalize-lists
+		Remove extra spaces and duplicate entries from values of tlp
+		settings which are lists, like USB_DENYLIST, in output of 'use'.
+	-keep-comments
+		Output comments immediately preceding settings, or their section
+		headers, in template along with the settings.
+	-explain
+		Log to STDERR, for each setting in output of 'use', values set by
+		each profile and which profile won, e.g.
+			TLP_ENABLE: default=0, ac=1 -> 1 (ac)
+	-count
+		Log a summary line after output of 'use': the number of settings,
+		how many come from each profile, and how many were overridden.
+	-annotate
+		Append a comment with the source profile to each output setting.
+	-auto <ac_profile>,<bat_profile>
+		Append AC or battery profile to selection of 'use' depending on
+		current power source. Falls back to <ac_profile> if detection fails.
+	-profiles <profile1>,<profile2>
+		Append comma-separated profiles to selection of 'use', after
+		ones given as arguments, e.g. -profiles=default,ac,dock.
+	-profiles-file <path>
+		Append profiles listed in file at <path>, one per line, to
+		selection of 'use'. Lines starting with '#' are comments.
+	-watch
+		Keep running 'use', producing output again each time template,
+		or files it includes, change. Errors are shown without exiting.
+		The screen is cleared before each output if STDOUT is a terminal.
+	-interactive
+		If 'use' is given no profiles, list profiles of template and read
+		selection of them by number from STDIN.
+	-apply
+		Run 'tlp start' after output of 'use' is written to -o path, or
+		files of -split. Requires root.
+	-dry-run
+		Report settings count per profile and overridden keys of 'use'
+		instead of producing output.
+	-drop-comments
+		Don't copy comments from config file with 'import'.
+	-allow-tabs
+		Accept a tab or spaces instead of '=' between key and value in
+		template, e.g. 'KEY<tab>VALUE'. Output always uses '='.
+	-allow-extended-keys
+		Accept hyphens and dots in keys of template, after the first
+		character, e.g. for settings of third-party drop-ins.
+	-allow-unset-env
+		Expand unset environment variables without default in template
+		values to empty string instead of failing.
+	-check-values
+		Warn about invalid values of known tlp settings, e.g. other than
+		0 or 1 for boolean ones.
+	-ignore-case
+		Match profile and alias names given to 'use' and 'diff' ignoring
+		case, e.g. 'AC' selects profile 'ac'.
+	-check-keys
+		Warn about keys unknown to tlp, suggesting the closest known ones.
+	-max-line-length <n>
+		Warn about template lines longer than <n> characters, which may
+		be lines joined by mistake. Lines are not limited by default.
+	-lint-unused-defaults
+		Make 'validate' fail if a setting of default profile is overridden
+		by every other profile, so that its value is never used.
+	-fix
+		Make 'validate' replace keys renamed by tlp, e.g. USB_BLACKLIST,
+		with their new names in template file first.
+	-v
+		Log informational messages, like selected profiles, to STDERR.
+		Only errors and warnings are logged by default.
+	-vv
+		Like -v, and also log how each setting of 'use' is resolved: its
+		value, profile and template line, and the value it overrides.
+	-color auto|always|never
+		Colorize errors, warnings and selected profiles in STDERR output.
+		'auto', the default, uses colors if STDERR is a terminal and
+		NO_COLOR environment variable is not set.
+	-quiet, -q
+		Log errors and warnings only, even if -v or -vv is passed.
+	-strict
+		Treat warnings as errors, exiting with non-zero code. These are
+		duplicate keys in a profile, duplicate section headers in a file,
+		keys renamed by tlp, lines longer than -max-line-length, unknown
+		keys and invalid values with -check-keys and -check-values,
+		profiles selected on hosts they are not meant for, failed power
+		source detection with -auto, profiles named like commands, and
+		output of 'use' without any settings.
+
+Exit codes:
+	0	success
+	1	other errors, e.g. failed writing output
+	2	bad command line arguments
+	3	template does not exist
+	4	template can't be parsed
+	5	selected profile does not exist or can't be selected
+`, tmpl, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, tool, templateFile, defaultHeader)
 }
 
-type kv struct{ key, value string }
-type sectionLine struct {
-	profile string
-	setting kv
+// merger returns merger of profiles with default profile named by
+// -default-name.
+func merger() tcprofiles.Merger {
+	return tcprofiles.Merger{DefaultName: *defaultName}
 }
 
-func getProfiles(sls []sectionLine) []string {
-	ps := make(map[string]struct{}, 0)
-	for _, sl := range sls {
-		ps[sl.profile] = struct{}{}
+// parseTemplate parses template file, or STDIN if template path is "-", or
+// all *.txt files in template directory, if it is set.
+func parseTemplate() (lines []tcprofiles.SectionLine, profiles []string, err error) {
+	host, _ := os.Hostname()
+	parser := tcprofiles.Parser{
+		Strict:          *strict,
+		CheckKeys:       *checkKeys,
+		CheckValues:     *checkValues,
+		AllowWhitespace: *allowTabs,
+		ExtendedKeys:    *extendedKeys,
+		LookupEnv:       os.LookupEnv,
+		AllowUnsetEnv:   *allowUnset,
+		Hostname:        host,
+		AllErrors:       allErrors,
+		MaxLineLength:   *maxLineLen,
+		DefaultName:     *defaultName,
+		Warn: func(msg string) {
+			logToErr("Warning: %s\n", msg)
+		},
 	}
+	if *templateDir != "" {
+		lines, err = parseTemplateDir(&parser, *templateDir)
+	} else if remoteTemplate() {
+		lines, err = fetchTemplate(&parser, *templatePath)
+	} else if *templatePath == "-" {
+		lines, err = parseTemplateReader(&parser, os.Stdin)
+	} else if *tmplFormat == "toml" {
+		lines, err = parser.ParseTOMLFile(*templatePath)
+	} else {
+		lines, err = parser.ParseFile(*templatePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines, merger().Profiles(lines), nil
+}
 
-	delete(ps, defaultProfileName)
+// filterHost drops settings of profiles restricted to other hosts from
+// template, warning about ones in selected.
+func filterHost(template []tcprofiles.SectionLine, selected []string) []tcprofiles.SectionLine {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logWarning("can't get host name (%v), host-specific profiles are skipped\n", err)
+	}
+	template, skipped := tcprofiles.FilterHost(template, hostname)
+	for _, p := range skipped {
+		if slices.Index(selected, p) >= 0 {
+			logWarning("profile %s is restricted to other hosts, skipped\n", p)
+		}
+	}
+	return template
+}
 
-	var psArr []string
-	for p := range ps {
-		psArr = append(psArr, p)
+// dropDefault returns template without settings of default profile, for
+// -no-default.
+func dropDefault(template []tcprofiles.SectionLine) []tcprofiles.SectionLine {
+	filtered := make([]tcprofiles.SectionLine, 0, len(template))
+	for _, sl := range template {
+		if !sl.IsSetting() || sl.Profile != *defaultName {
+			filtered = append(filtered, sl)
+		}
 	}
-	slices.Sort(psArr)
+	return filtered
+}
 
-	return append([]string{defaultProfileName}, psArr...)
+// parseTemplateDir parses *.txt files in dir, sorted by name, as a single
+// template.
+func parseTemplateDir(parser *tcprofiles.Parser, dir string) ([]tcprofiles.SectionLine, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *.txt files in template directory %s", dir)
+	}
+	return parser.ParseFiles(paths...)
 }
 
-var sectionRegex = regexp.MustCompile(`^\[.*\]$`)
-var validSectionNameRegex = regexp.MustCompile(`^[\w\d]+$`)
-var keyValRegex = regexp.MustCompile(`^([\w]+?)=(.+)$`)
+// remoteTemplate reports whether template is read from an HTTP(S) URL.
+func remoteTemplate() bool {
+	return *templateDir == "" && (strings.HasPrefix(*templatePath, "http://") || strings.HasPrefix(*templatePath, "https://"))
+}
 
-func parseTemplate() (lines []sectionLine, profiles []string, err error) {
-	f, err := os.Open(templateFile)
+// fetchTemplate parses template fetched from url. Includes are resolved
+// relative to the current directory, as for template read from STDIN.
+func fetchTemplate(parser *tcprofiles.Parser, url string) ([]tcprofiles.SectionLine, error) {
+	client := http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
 	if err != nil {
-		return nil, nil, err
+		return nil, fetchError{fmt.Errorf("fetching template: %v", err)}
 	}
-	defer f.Close()
-	bf := bufio.NewReader(f)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fetchError{fmt.Errorf("fetching template %s: %s", url, resp.Status)}
+	}
+	return parseTemplateReader(parser, resp.Body)
+}
 
-	curProfile := defaultProfileName
-	lineNum := 0
-	for {
-		lineNum++
-		line, err := bf.ReadString('\n')
-		if err != nil && !errors.Is(err, io.EOF) {
-			return nil, nil, fmt.Errorf("template read line %d error: %v", lineNum, err)
-		}
+// fetchError is an error of fetching remote template, which counts as the
+// template not existing.
+type fetchError struct {
+	err error
+}
 
-		line = strings.TrimSpace(line)
-		if len(line) == 0 || line[0] == '#' {
-			if errors.Is(err, io.EOF) {
-				break
-			}
-			continue
-		}
-		if sectionRegex.MatchString(line) {
-			p := line[1 : len(line)-1]
-			if !validSectionNameRegex.MatchString(p) {
-				return nil, nil, fmt.Errorf("malformed section name %q at line %d. Latin letters, digits and underscores only",
-					p, lineNum)
-			}
-			curProfile = p
-		} else {
-			kvMatches := keyValRegex.FindStringSubmatch(line)
-			if len(kvMatches) < 3 {
-				return nil, nil, fmt.Errorf("malformed template line %d: %s", lineNum, line)
-			}
-			lines = append(lines, sectionLine{
-				profile: curProfile,
-				setting: kv{
-					key:   kvMatches[1],
-					value: kvMatches[2],
-				},
-			})
-		}
+func (e fetchError) Error() string {
+	return e.err.Error()
+}
 
-		if errors.Is(err, io.EOF) {
-			break
-		}
+func (e fetchError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// parseTemplateReader parses template read from r in -template-format.
+func parseTemplateReader(parser *tcprofiles.Parser, r io.Reader) ([]tcprofiles.SectionLine, error) {
+	if *tmplFormat == "toml" {
+		return parser.ParseTOML(r)
 	}
-	return lines, getProfiles(lines), nil
+	return parser.Parse(r)
 }
 
-func lastIndex[S ~[]E, E comparable](s S, v E) int {
-	for i := len(s) - 1; i != 0; i-- {
-		if v == s[i] {
-			return i
+// parseArgs parses flags, allowing them to be placed anywhere between
+// positional arguments, and returns positional arguments in their order.
+func parseArgs(args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flag.CommandLine.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flag.Args()
+		if len(args) == 0 {
+			return positional, nil
 		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-	return -1
+}
+
+// flagSet reports whether flag with name was given on command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func parseInput() (profiles []string, err error) {
-	inputs := os.Args[1:]
-	if len(inputs) == 0 {
+	if len(os.Args) < 2 {
 		return nil, errNoArguments
 	}
 
 	h := flag.Bool("help", false, "")
 	hs := flag.Bool("h", false, "")
-	flag.Parse()
+	flag.Usage = printUsage
+	inputs, err := parseArgs(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
 
-	if *h || *hs {
+	if !flagSet("template") {
+		if env := os.Getenv(templateEnv); env != "" {
+			*templatePath = env
+		}
+	}
+
+	if err := setColorMode(*colorMode); err != nil {
+		return nil, err
+	}
+	if !tcprofiles.ValidProfileName(*defaultName) {
+		return nil, fmt.Errorf("malformed default profile name %q", *defaultName)
+	}
+	if *tmplFormat != "ini" && *tmplFormat != "toml" {
+		return nil, fmt.Errorf("unknown template format %q, expected ini or toml", *tmplFormat)
+	}
+	if *maxLineLen < 0 {
+		return nil, fmt.Errorf("-max-line-length must not be negative, got %d", *maxLineLen)
+	}
+	if *tmplFormat == "toml" && *templateDir != "" {
+		return nil, errors.New("-template-dir can't be used with -template-format toml")
+	}
+	switch {
+	case *quiet || *quietShort:
+		verbosity = 0
+	case *veryVerbose:
+		verbosity = 2
+	case *verbose:
+		verbosity = 1
+	}
+
+	if *h || *hs || len(inputs) == 0 {
 		return nil, errNoArguments
 	}
 
-	if inputs[0] == "template" {
+	switch inputs[0] {
+	case "template":
 		createTemplateFile()
 		os.Exit(0)
+	case "list":
+		listProfiles()
+		os.Exit(0)
+	case "keys":
+		listKeys()
+		os.Exit(0)
+	case "redundant":
+		if len(inputs) != 1 {
+			return nil, errors.New("redundant expects no arguments")
+		}
+		listRedundant()
+		os.Exit(0)
+	case "validate":
+		allErrors = true
+		if *fixKeys {
+			fixDeprecatedKeys()
+		}
+		validateTemplate()
+		os.Exit(0)
+	case "import":
+		if len(inputs) < 2 || len(inputs) > 3 {
+			return nil, errors.New("import expects a config file and an optional profile name")
+		}
+		profile := *defaultName
+		if len(inputs) == 3 {
+			profile = inputs[2]
+		}
+		importConfig(inputs[1], profile)
+		os.Exit(0)
+	case "set":
+		if len(inputs) != 3 || !tcprofiles.IsSettingLine(inputs[2]) {
+			return nil, errors.New("set expects a profile name and a KEY=VALUE setting")
+		}
+		key, value, _ := strings.Cut(inputs[2], "=")
+		setSetting(inputs[1], strings.TrimSpace(key), strings.TrimSpace(value))
+		os.Exit(0)
+	case "delete":
+		if len(inputs) != 2 {
+			return nil, errors.New("delete expects a profile name")
+		}
+		deleteProfile(inputs[1])
+		os.Exit(0)
+	case "rename":
+		if len(inputs) != 3 {
+			return nil, errors.New("rename expects current and new profile names")
+		}
+		renameProfile(inputs[1], inputs[2])
+		os.Exit(0)
+	case "promote":
+		if len(inputs) != 2 {
+			return nil, errors.New("promote expects a profile name")
+		}
+		promoteProfile(inputs[1])
+		os.Exit(0)
+	case "fmt":
+		if len(inputs) != 1 {
+			return nil, errors.New("fmt expects no arguments")
+		}
+		formatTemplate(*checkFormat)
+		os.Exit(0)
+	case "completion":
+		if len(inputs) != 2 {
+			return nil, errors.New("completion expects a shell name: bash, zsh or fish")
+		}
+		if err := printCompletion(inputs[1]); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	case "version":
+		printVersion()
+		os.Exit(0)
+	case "show":
+		if len(inputs) != 2 {
+			return nil, errors.New("show expects a profile name")
+		}
+		showProfile(inputs[1])
+		os.Exit(0)
+	case "dump-all":
+		if len(inputs) != 1 {
+			return nil, errors.New("dump-all expects no arguments")
+		}
+		dumpAll()
+		os.Exit(0)
+	case "diff":
+		if len(inputs) != 3 {
+			return nil, errors.New("diff expects two profile names")
+		}
+		diffProfiles(inputs[1], inputs[2])
+		os.Exit(0)
 	}
 
 	if inputs[0] != "use" {
 		return nil, fmt.Errorf("unknown command %q", inputs[0])
 	}
 
+	if *format != "ini" && *format != "json" && *format != "env" {
+		return nil, fmt.Errorf("unknown output format %q, expected ini, json or env", *format)
+	}
+	if *mergeOrder != "selection-order" && *mergeOrder != "template-order" {
+		return nil, fmt.Errorf("unknown merge strategy %q, expected selection-order or template-order", *mergeOrder)
+	}
+
+	if *watch {
+		if err := watchTemplate(); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+
+	if *split && *outputPath != "" {
+		return nil, errors.New("-split writes a file per profile, use -out-dir instead of -o")
+	}
+	if *split && *toStdout {
+		return nil, errors.New("-split writes a file per profile, -stdout can't be used with it")
+	}
+	if *diffPath != "" && (*split || *outputPath != "" || *apply) {
+		return nil, errors.New("-diff only compares output, it can't be used with -o, -split or -apply")
+	}
+	if *apply && *outputPath == "" && !*split {
+		// tlp could read the config before a piped 'tee' writes it.
+		return nil, errors.New("-apply can only be used with -o or -split, to run 'tlp start' after the config is written")
+	}
+	if flagSet("out-dir") && !*split {
+		return nil, errors.New("-out-dir can only be used with -split")
+	}
+
 	inputs = inputs[1:]
 
-	if len(inputs) == 0 {
+	if *profileList != "" {
+		for _, p := range strings.Split(*profileList, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				return nil, fmt.Errorf("empty profile name in -profiles %q", *profileList)
+			}
+			inputs = append(inputs, p)
+		}
+	}
+
+	if *preamble != "" {
+		if *format == "json" {
+			return nil, errors.New("-preamble can't be used with -format json")
+		}
+		text, err := readPreamble(*preamble)
+		if err != nil {
+			return nil, err
+		}
+		preambleText = text
+	}
+
+	if *profilesFile != "" {
+		fromFile, err := readProfilesFile(*profilesFile)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, fromFile...)
+	}
+
+	for _, p := range inputs {
+		if err := checkReserved(p); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, p := range inputs {
+		name, ok := strings.CutPrefix(p, "@")
+		if !ok {
+			continue
+		}
+		value, set := os.LookupEnv(name)
+		if value = strings.TrimSpace(value); value == "" {
+			if !set {
+				return nil, fmt.Errorf("environment variable %s of %s is not set", name, p)
+			}
+			return nil, fmt.Errorf("environment variable %s of %s is empty", name, p)
+		}
+		inputs[i] = value
+	}
+
+	if len(inputs) == 0 && *interactive {
+		if inputs, err = pickProfiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(inputs) == 0 && *auto == "" {
 		return nil, errNoProfileSelected
 	}
 
@@ -262,55 +1242,521 @@ func parseInput() (profiles []string, err error) {
 		profiles = append(profiles, inputs[i])
 	}
 
-	if len(profiles) > 0 && lastIndex(profiles, defaultProfileName) > 0 {
-		return nil, fmt.Errorf("default profile must be the only, or the first of many selections.\n\tGot %q",
-			strings.Join(profiles, ","))
+	if *auto != "" {
+		p, err := autoProfile(*auto)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, p)
 	}
 
 	return profiles, nil
 }
 
+// checkReserved reports name of a command used as a profile name, which would
+// be confusing, e.g. in 'use template'.
+func checkReserved(name string) error {
+	if slices.Index(commands, name) >= 0 {
+		return fmt.Errorf("%q is a command name and can't be used as a profile name", name)
+	}
+	return nil
+}
+
+// readProfilesFile reads profile names from file at path, one per line.
+// Empty lines and comments starting with '#' or ';' are skipped.
+func readProfilesFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read profiles file: %v", err)
+	}
+	var profiles []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' && line[0] != ';' {
+			profiles = append(profiles, line)
+		}
+	}
+	return profiles, nil
+}
+
+// readPreamble reads file at path to be put into config as is. It can only
+// have comments and empty lines, so that it doesn't change settings.
+func readPreamble(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("can't read preamble file: %v", err)
+	}
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	for i, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" && line[0] != '#' {
+			return "", fmt.Errorf("preamble file %s line %d is not a comment: %s", path, i+1, line)
+		}
+	}
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text, nil
+}
+
 func createTemplateFile() {
-	f, err := os.OpenFile(templateFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if *templatePath == "-" {
+		logToOut("%s", template)
+		return
+	}
+	if remoteTemplate() {
+		logToErr("Error: can't create template at URL %s\n", *templatePath)
+		os.Exit(exitUsage)
+	}
+	if *tmplFormat == "toml" {
+		logToErr("Error: 'template' creates ini templates only, write TOML template by hand\n")
+		os.Exit(exitUsage)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*templatePath), 0755); err != nil {
+		logToErr("Error creating template directory: %v\n", err)
+		os.Exit(exitError)
+	}
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		if _, err := os.Stat(*templatePath); err == nil && !*yes && !confirm("Overwrite template "+*templatePath+"?") {
+			logToErr("Template %s is left as is\n", *templatePath)
+			os.Exit(exitError)
+		}
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*templatePath, mode, 0644)
 	if err != nil {
 		if errors.Is(err, os.ErrExist) {
-			logToErr("Error creating template file %q: already exists\n", templateFile)
+			logToErr("Error creating template file %q: already exists, pass -force to overwrite it\n", *templatePath)
 		} else {
 			logToErr("Error creating template: %v\n", err)
 		}
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	defer f.Close()
 
 	f.WriteString(template)
 }
 
-func fillConfig(config *strings.Builder, template []sectionLine, selected []string) {
-	fmt.Fprintf(config, "# Generated by tcprofiles command\n\n")
+// confirm asks question on STDERR and reports whether it is answered with
+// yes on STDIN.
+func confirm(question string) bool {
+	logToErr("%s [y/N]: ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		logToErr("\n")
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
 
-	if selected[0] == defaultProfileName {
-		selected = selected[1:]
+func printVersion() {
+	v := version
+	if bi, ok := debug.ReadBuildInfo(); ok && v == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		v = bi.Main.Version
 	}
+	logToOut("tcprofiles %s (%s)\n", v, runtime.Version())
+}
 
-	templateCache := slices.Clone(template)
-	settings := make([]kv, 0)
-	settingIdx := make(map[string]int)
+// templateName returns template directory, if set, or template file path.
+func templateName() string {
+	if *templateDir != "" {
+		return *templateDir
+	}
+	return *templatePath
+}
 
-	for _, profile := range append([]string{defaultProfileName}, selected...) {
-		for i := 0; i < len(templateCache); i++ {
-			if templateCache[i].profile != profile {
+// logTemplateError logs template parse error, pointing at the error column
+// of the line with a caret if it is known. Joined errors are logged one by
+// one.
+func logTemplateError(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			logTemplateError(err)
+		}
+		return
+	}
+	if logJSONError(err, "") {
+		return
+	}
+	logToErr("Template error: %v\n", err)
+	var se *tcprofiles.SyntaxError
+	if errors.As(err, &se) {
+		pad := strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return r
+			}
+			return ' '
+		}, se.Text[:se.Column-1])
+		logToErr("\t%s\n\t%s^\n", se.Text, pad)
+		if c := se.Text[se.Column-1:]; !*extendedKeys && (strings.HasPrefix(c, "-") || strings.HasPrefix(c, ".")) {
+			logToErr("Keys can only contain Latin letters, digits and underscores, " +
+				"pass -allow-extended-keys to allow hyphens and dots\n")
+		}
+	}
+}
+
+// loadTemplate parses template, exiting with a message if it fails.
+func loadTemplate() ([]tcprofiles.SectionLine, []string) {
+	lines, profiles, err := parseTemplate()
+	if err != nil {
+		var fe fetchError
+		if errors.As(err, &fe) {
+			logToErr("Error: %v\n", err)
+			os.Exit(exitNoTemplate)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			logToErr("Error: template %q does not exist\n", templateName())
+			os.Exit(exitNoTemplate)
+		}
+		logTemplateError(err)
+		os.Exit(exitTemplateError)
+	}
+	return lines, profiles
+}
+
+// validateTemplate checks that template parses, without producing any config.
+func validateTemplate() {
+	lines, profiles := loadTemplate()
+	settings := 0
+	for _, sl := range lines {
+		if sl.IsSetting() {
+			settings++
+		}
+	}
+	if *lintDefaults {
+		if unused := unusedDefaults(lines, profiles); len(unused) > 0 {
+			for _, key := range unused {
+				logToErr("Error: default value of %s is never used, every profile overrides it\n", key)
+			}
+			os.Exit(exitTemplateError)
+		}
+	}
+	logToOut("OK: %d profiles, %d settings\n", len(profiles), settings)
+}
+
+// unusedDefaults returns keys of default profile, sorted, which every other
+// profile sets again or removes, itself or through profiles it extends, so
+// that the default value never reaches the output. Appending to a key alone
+// uses its default value.
+func unusedDefaults(lines []tcprofiles.SectionLine, profiles []string) []string {
+	if len(profiles) < 2 {
+		return nil
+	}
+	overrides := make(map[string]int) // key -> number of profiles overriding it
+	for _, p := range profiles[1:] {
+		overridden := make(map[string]bool)
+		for _, sl := range merger().Contributions(lines, []string{p}) {
+			if sl.Profile != *defaultName && !sl.Append {
+				overridden[sl.Setting.Key] = true
+			}
+		}
+		for key := range overridden {
+			overrides[key]++
+		}
+	}
+
+	var unused []string
+	for _, sl := range lines {
+		key := sl.Setting.Key
+		if sl.IsSetting() && sl.Profile == *defaultName && !sl.Unset &&
+			overrides[key] == len(profiles)-1 && slices.Index(unused, key) < 0 {
+			unused = append(unused, key)
+		}
+	}
+	slices.Sort(unused)
+	return unused
+}
+
+// listProfiles prints profiles found in template, one per line, along with
+// the number of settings each of them defines and its description, if any.
+func listProfiles() {
+	lines, profiles := loadTemplate()
+	descriptions := tcprofiles.Descriptions(lines)
+
+	counts := make(map[string]int, len(profiles))
+	for _, sl := range lines {
+		if sl.IsSetting() {
+			counts[sl.Profile]++
+		}
+	}
+	for _, p := range profiles {
+		if d, ok := descriptions[p]; ok {
+			logToOut("%s\t%d\t%s\n", p, counts[p], d)
+		} else {
+			logToOut("%s\t%d\n", p, counts[p])
+		}
+	}
+}
+
+// listKeys prints keys set in template, sorted, one per line along with
+// profiles setting each of them, in template order.
+func listKeys() {
+	lines, _ := loadTemplate()
+
+	keyProfiles := make(map[string][]string)
+	for _, sl := range lines {
+		if !sl.IsSetting() || sl.Unset {
+			continue
+		}
+		key := sl.Setting.Key
+		if slices.Index(keyProfiles[key], sl.Profile) < 0 {
+			keyProfiles[key] = append(keyProfiles[key], sl.Profile)
+		}
+	}
+	keys := make([]string, 0, len(keyProfiles))
+	for key := range keyProfiles {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		logToOut("%s\t%s\n", key, strings.Join(keyProfiles[key], ", "))
+	}
+}
+
+// listRedundant prints keys set by more than one profile, each time to the
+// same value, sorted, along with the value and the profiles setting them.
+// Keys also removed or appended to anywhere are skipped, as moving them to
+// default profile would change the result.
+func listRedundant() {
+	lines, _ := loadTemplate()
+
+	keyProfiles := make(map[string][]string)
+	values := make(map[string]string)
+	skipped := make(map[string]bool)
+	for _, sl := range lines {
+		if !sl.IsSetting() {
+			continue
+		}
+		key := sl.Setting.Key
+		if value, ok := values[key]; sl.Unset || sl.Append || ok && value != sl.Setting.Value {
+			skipped[key] = true
+			continue
+		}
+		values[key] = sl.Setting.Value
+		if slices.Index(keyProfiles[key], sl.Profile) < 0 {
+			keyProfiles[key] = append(keyProfiles[key], sl.Profile)
+		}
+	}
+	var keys []string
+	for key, profiles := range keyProfiles {
+		if len(profiles) > 1 && !skipped[key] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		logInfo("No keys set to the same value by several profiles\n")
+		return
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		logToOut("%s=%s\t%s\n", key, tcprofiles.QuoteValue(values[key]), strings.Join(keyProfiles[key], ", "))
+	}
+}
+
+// fillConfig writes merged settings of selected profiles to config and returns
+// the number of settings written. With -format env settings are written as
+// shell exports, skipping keys which can't be shell variable names.
+func fillConfig(config *strings.Builder, template []tcprofiles.SectionLine, selected []string) int {
+	if !*noHeader {
+		h := *header
+		if *noTimestamp && !flagSet("header") {
+			h = noTimestampHeader
+		}
+		fmt.Fprintf(config, "%s\n", headerComment(h, selected, time.Now()))
+	}
+	if preambleText != "" {
+		fmt.Fprintf(config, "%s\n", preambleText)
+	}
+
+	logResolution(template, selected)
+	settings := resolveSettings(template, selected)
+	if *sortKeys {
+		slices.SortFunc(settings, func(a, b tcprofiles.SectionLine) int {
+			return strings.Compare(a.Setting.Key, b.Setting.Key)
+		})
+	}
+	if *explain {
+		explainSettings(template, selected, settings)
+	}
+	count := 0
+	for _, sl := range settings {
+		line := fmt.Sprintf("%s=%s", sl.Setting.Key, sl.ConfigValue())
+		if *format == "env" {
+			if !shellName(sl.Setting.Key) {
+				logWarning("key %s of profile %s is not a valid shell variable name, skipped\n", sl.Setting.Key, sl.Profile)
 				continue
 			}
-			settings = append(settings, templateCache[i].setting)
-			settingIdx[templateCache[i].setting.key] = len(settings) - 1
-			templateCache = append(templateCache[:i], templateCache[i+1:]...)
-			i--
+			line = fmt.Sprintf("export %s=%s", sl.Setting.Key, shellQuote(sl.Setting.Value))
+		}
+		if *keepComments && sl.Comment != "" {
+			fmt.Fprintf(config, "%s\n", sl.Comment)
 		}
+		if *annotate {
+			fmt.Fprintf(config, "%s # from %s\n", line, sl.Profile)
+		} else {
+			fmt.Fprintf(config, "%s\n", line)
+		}
+		count++
+	}
+	return count
+}
+
+// shellName reports whether key can be a shell variable name.
+func shellName(key string) bool {
+	for i, r := range key {
+		if r != '_' && (r > unicode.MaxASCII || !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// shellQuote quotes value for POSIX shell with single quotes, which keep
+// everything but single quotes as is.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// resolveSettings returns settings which win the merge of selected profiles,
+// with list values normalized if -normalize-lists is passed.
+func resolveSettings(template []tcprofiles.SectionLine, selected []string) []tcprofiles.SectionLine {
+	settings := merger().Resolve(template, selected)
+	if *normalize {
+		for i, sl := range settings {
+			if tcprofiles.ListKey(sl.Setting.Key) && !sl.Raw {
+				settings[i].Setting.Value = tcprofiles.NormalizeList(sl.Setting.Value)
+			}
+		}
+	}
+	return settings
+}
+
+// headerComment returns header of produced config as comment lines,
+// replacing {profiles} with selected profiles, including default one unless
+// -no-default is passed, and {time} with t.
+func headerComment(header string, selected []string, t time.Time) string {
+	if !*noDefault && (len(selected) == 0 || selected[0] != *defaultName) {
+		selected = append([]string{*defaultName}, selected...)
+	}
+	r := strings.NewReplacer("{profiles}", strings.Join(selected, ", "), "{time}", t.Format(time.RFC3339))
+	sb := strings.Builder{}
+	for _, line := range strings.Split(r.Replace(header), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			line = "# " + line
+		}
+		fmt.Fprintf(&sb, "%s\n", line)
+	}
+	return sb.String()
+}
+
+// fillJSON writes merged settings of selected profiles to config as a JSON
+// object with sorted keys and returns the number of settings written.
+func fillJSON(config *strings.Builder, template []tcprofiles.SectionLine, selected []string) (int, error) {
+	logResolution(template, selected)
+	settings := resolveSettings(template, selected)
+	if *explain {
+		explainSettings(template, selected, settings)
+	}
+	obj := make(map[string]string, len(settings))
+	for _, sl := range settings {
+		obj[sl.Setting.Key] = sl.Setting.Value
+	}
+
+	data, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return 0, err
 	}
+	config.Write(data)
+	config.WriteByte('\n')
+	return len(settings), nil
+}
 
-	for idx, setting := range settings {
-		if settingIdx[setting.key] == idx {
-			fmt.Fprintf(config, "%s=%s\n", setting.key, setting.value)
+// logResolution logs each setting of selected profiles in order they are
+// applied, along with the value it overrides.
+func logResolution(template []tcprofiles.SectionLine, selected []string) {
+	if verbosity < 2 {
+		return
+	}
+	last := make(map[string]tcprofiles.SectionLine)
+	for _, sl := range merger().Contributions(template, selected) {
+		if prev, ok := last[sl.Setting.Key]; ok {
+			logDebug("%s: %s -> %s (%s -> %s, line %d)\n", sl.Setting.Key,
+				displayValue(prev), displayValue(sl), prev.Profile, sl.Profile, sl.LineNum)
+		} else {
+			logDebug("%s: %s (%s, line %d)\n", sl.Setting.Key, displayValue(sl), sl.Profile, sl.LineNum)
 		}
+		last[sl.Setting.Key] = sl
+	}
+}
+
+// explainSettings logs, for each of resolved settings, values of all profiles
+// which touched its key, in order they are applied, and the resulting value.
+func explainSettings(template []tcprofiles.SectionLine, selected []string, settings []tcprofiles.SectionLine) {
+	provenance := make(map[string]tcprofiles.ResolvedSetting)
+	for _, rs := range merger().Provenance(template, selected) {
+		provenance[rs.Setting.Key] = rs
+	}
+	for _, sl := range settings {
+		rs := provenance[sl.Setting.Key]
+		contributions := make([]string, 0, len(rs.Contributors))
+		for _, c := range rs.Contributors {
+			value := "(unset)"
+			if !c.Unset {
+				value = tcprofiles.QuoteValue(c.Setting.Value)
+			}
+			if c.Append {
+				value = "+" + value
+			}
+			contributions = append(contributions, fmt.Sprintf("%s=%s", c.Profile, value))
+		}
+		logToErr("%s: %s -> %s (%s)\n", sl.Setting.Key, strings.Join(contributions, ", "),
+			tcprofiles.QuoteValue(sl.Setting.Value), rs.Profile)
+	}
+}
+
+// displayValue returns value of setting for reports, marking unset ones.
+func displayValue(sl tcprofiles.SectionLine) string {
+	if sl.Unset {
+		return "(unset)"
 	}
+	if sl.Append {
+		return "+" + sl.Setting.Value
+	}
+	return sl.Setting.Value
+}
+
+// printDryRun reports how selected profiles would be merged, without
+// producing the config.
+func printDryRun(template []tcprofiles.SectionLine, selected []string) {
+	settings := merger().Contributions(template, selected)
+
+	var order []string
+	counts := make(map[string]int)
+	for _, sl := range settings {
+		if counts[sl.Profile] == 0 {
+			order = append(order, sl.Profile)
+		}
+		counts[sl.Profile]++
+	}
+	for _, p := range order {
+		logToErr("Settings from %s: %d\n", p, counts[p])
+	}
+
+	last := make(map[string]tcprofiles.SectionLine, len(settings))
+	var overrides []string
+	for _, sl := range settings {
+		if prev, ok := last[sl.Setting.Key]; ok && !prev.Unset {
+			overrides = append(overrides, fmt.Sprintf("\t%s: %s -> %s (%s -> %s)\n",
+				sl.Setting.Key, prev.Setting.Value, displayValue(sl), prev.Profile, sl.Profile))
+		}
+		last[sl.Setting.Key] = sl
+	}
+	if len(overrides) > 0 {
+		logToErr("Overridden:\n%s", strings.Join(overrides, ""))
+	}
+
+	logToErr("Total settings: %d\n", len(merger().Resolve(template, selected)))
+	logToErr("Dry run, no output produced\n")
 }
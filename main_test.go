@@ -0,0 +1,165 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/amanofbits/tcprofiles/pkg/tcprofiles"
+)
+
+// templateLines splits text ending with newline into template file lines.
+func templateLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	return lines[:len(lines)-1]
+}
+
+func TestFormatLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		in, want string
+		sortKeys bool
+	}{
+		{
+			name: "spaces and blank lines",
+			in:   "  TLP_ENABLE = 1  \n\n\n# ac\n[ ac ]\n\n\tCPU_BOOST_ON_AC =1\nextends=x\n",
+			want: "TLP_ENABLE=1\n\n# ac\n[ac]\nCPU_BOOST_ON_AC=1\nextends = x\n",
+		},
+		{
+			name: "directives",
+			in:   "[alias  a = ac ]\n[group: g]=ac,bat\nhost=a,b\ninclude   common.txt\nUSB_DENYLIST  +=  1234:5678\n",
+			want: "[alias a=ac]\n[group:g] = ac, bat\nhost = a, b\ninclude common.txt\nUSB_DENYLIST+=1234:5678\n",
+		},
+		{
+			name: "raw values kept",
+			in:   "raw   USB_DENYLIST,DISK_DEVICES\nUSB_DENYLIST=  \"1234:5678\"  # keep\n  DISK_DEVICES = sda  \nTLP_ENABLE = 1 # x\n",
+			want: "raw USB_DENYLIST, DISK_DEVICES\nUSB_DENYLIST=  \"1234:5678\"  # keep\nDISK_DEVICES= sda  \nTLP_ENABLE=1 # x\n",
+		},
+		{
+			name:     "comments move with settings",
+			in:       "# b\nB=1\n# a1\n# a2\nA=1\n!C\n\nZ=1\nY=1\n[ac]\nD=1\nC=1\n",
+			want:     "# a1\n# a2\nA=1\n# b\nB=1\n!C\n\nY=1\nZ=1\n\n[ac]\nC=1\nD=1\n",
+			sortKeys: true,
+		},
+		{
+			name:     "directives split groups",
+			in:       "B=1\nraw A\nA=2\n[ac]\nextends = x\nD=1\nC=1\n",
+			want:     "B=1\nraw A\nA=2\n\n[ac]\nextends = x\nC=1\nD=1\n",
+			sortKeys: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatLines(templateLines(tt.in), tt.sortKeys)
+			if strings.Join(got, "") != tt.want {
+				t.Errorf("formatLines() = %q, want %q", strings.Join(got, ""), tt.want)
+			}
+			if again := formatLines(got, tt.sortKeys); !slices.Equal(again, got) {
+				t.Errorf("formatting again changed lines to %q", strings.Join(again, ""))
+			}
+		})
+	}
+}
+
+func TestSplitSections(t *testing.T) {
+	in := templateLines("A=1\n\n# ac\n[ac]\nB=1\n[alias a=ac]\n# bat\n# more\n[bat]\n")
+	want := []templateSection{
+		{profile: "default", header: -1, start: 0, end: 2},
+		{profile: "ac", header: 3, start: 2, end: 6},
+		{profile: "bat", header: 8, start: 6, end: 9},
+	}
+	if got := splitSections(in); !slices.Equal(got, want) {
+		t.Errorf("splitSections() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSetKeyLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		profile string
+		key     string
+		want    string
+	}{
+		{"replace", "A=1\n[ac]\nB=1\nB=2\n# c\n", "ac", "B", "A=1\n[ac]\nB=1\nB=3\n# c\n"},
+		{"after last setting", "A=1\n\n[ac]\nB=1\n# c\n\n[bat]\n", "ac", "C", "A=1\n\n[ac]\nB=1\nC=3\n# c\n\n[bat]\n"},
+		{"empty section", "[ac]\n[bat]\nB=1\n", "ac", "C", "[ac]\nC=3\n[bat]\nB=1\n"},
+		{"default", "# top\n\n[ac]\nB=1\n", "default", "A", "# top\n\nA=3\n\n[ac]\nB=1\n"},
+		{"new section", "A=1\n", "bat", "C", "A=1\n\n[bat]\nC=3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := setKeyLine(templateLines(tt.in), tt.profile, tt.key, tt.key+"=3\n")
+			if strings.Join(got, "") != tt.want {
+				t.Errorf("setKeyLine() = %q, want %q", strings.Join(got, ""), tt.want)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			"changed",
+			"A=1\nB=1\nC=1\n", "A=1\nB=2\nC=1\nD=1\n",
+			"--- old\n+++ new\n@@ -1,3 +1,4 @@\n A=1\n-B=1\n+B=2\n C=1\n+D=1\n",
+		},
+		{"from nothing", "", "A=1\n", "--- old\n+++ new\n@@ -0,0 +1 @@\n+A=1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("old", "new", splitLines(tt.a), splitLines(tt.b)); got != tt.want {
+				t.Errorf("unifiedDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tlp.conf")
+	old := "# Generated at 2024-01-02T03:04:05Z\n# ac\nA=1\n"
+	if err := os.WriteFile(path, []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config string
+		want   bool
+	}{
+		{"other time", "# Generated at 2025-06-07T08:09:10+02:00\n# ac\nA=1\n", false},
+		{"other header", "# Generated at 2024-01-02T03:04:05Z\n# bat\nA=1\n", true},
+		{"other setting", "# Generated at 2025-06-07T08:09:10Z\n# ac\nA=2\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			differ, err := diffConfig(path, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if differ != tt.want {
+				t.Errorf("diffConfig() = %v, want %v", differ, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchTemplateNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	for _, url := range []string{srv.URL + "/template.txt", "http://127.0.0.1:0/template.txt"} {
+		if _, err := fetchTemplate(&tcprofiles.Parser{}, url); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("fetchTemplate(%q) error = %v, want one matching os.ErrNotExist", url, err)
+		}
+	}
+}
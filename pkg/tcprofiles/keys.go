@@ -0,0 +1,125 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	_ "embed"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+//go:embed tlp_keys.txt
+var tlpKeysFile string
+
+// knownKeys maps setting names known to tlp to types of their values, empty
+// if the type is not checked.
+var knownKeys = func() map[string]string {
+	keys := make(map[string]string)
+	for _, line := range strings.Split(tlpKeysFile, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			key, typ, _ := strings.Cut(line, " ")
+			keys[key] = typ
+		}
+	}
+	return keys
+}()
+
+//go:embed tlp_deprecated_keys.txt
+var tlpDeprecatedKeysFile string
+
+// deprecatedKeys maps setting names renamed by tlp to their new names.
+var deprecatedKeys = func() map[string]string {
+	keys := make(map[string]string)
+	for _, line := range strings.Split(tlpDeprecatedKeysFile, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			key, replacement, _ := strings.Cut(line, " ")
+			keys[key] = strings.TrimSpace(replacement)
+		}
+	}
+	return keys
+}()
+
+// ReplacementKey returns the name replacing setting name key deprecated by
+// tlp, and whether key is deprecated.
+func ReplacementKey(key string) (string, bool) {
+	replacement, ok := deprecatedKeys[key]
+	return replacement, ok
+}
+
+// KnownKey reports whether key is a setting name known to tlp.
+func KnownKey(key string) bool {
+	_, ok := knownKeys[key]
+	return ok
+}
+
+// ListKey reports whether value of tlp setting key is a list of
+// space-separated entries.
+func ListKey(key string) bool {
+	return knownKeys[key] == "list"
+}
+
+// NormalizeList returns list value without extra whitespace and duplicate
+// entries, keeping the first occurrence of each.
+func NormalizeList(value string) string {
+	return AppendList("", value)
+}
+
+// CheckValue reports value which is not valid for tlp setting key, e.g. a
+// value other than 0 or 1 for a boolean setting. Values of keys with unknown
+// type are not checked.
+func CheckValue(key, value string) error {
+	typ := knownKeys[key]
+	switch {
+	case typ == "bool":
+		if value != "0" && value != "1" {
+			return fmt.Errorf("invalid value %q for %s, expected 0 or 1", value, key)
+		}
+	case typ == "int":
+		if value == "" || strings.Trim(value, "0123456789") != "" {
+			return fmt.Errorf("invalid value %q for %s, expected non-negative integer", value, key)
+		}
+	case strings.HasPrefix(typ, "enum:"):
+		allowed := strings.Split(typ[len("enum:"):], ",")
+		if slices.Index(allowed, value) < 0 {
+			return fmt.Errorf("invalid value %q for %s, expected one of %s", value, key, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// SuggestKey returns known tlp setting name closest to key, or empty string if
+// none is close enough.
+func SuggestKey(key string) string {
+	best, bestDist := "", len(key)/3+1
+	for known := range knownKeys {
+		d := editDistance(key, known)
+		if d < bestDist || (d == bestDist && best != "" && known < best) {
+			best, bestDist = known, d
+		}
+	}
+	return best
+}
+
+// editDistance returns Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
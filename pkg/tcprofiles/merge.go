@@ -0,0 +1,401 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Merger merges profiles of templates. Zero value is ready to use, package
+// functions like Resolve use it.
+type Merger struct {
+	// DefaultName is the name of the profile which is always applied first,
+	// DefaultProfile if empty. It must be the same as Parser.DefaultName of
+	// parsed template lines.
+	DefaultName string
+}
+
+func (m Merger) defaultName() string {
+	if m.DefaultName == "" {
+		return DefaultProfile
+	}
+	return m.DefaultName
+}
+
+// CheckSelection calls Merger.CheckSelection of zero Merger.
+func CheckSelection(profiles, selected []string) error {
+	return Merger{}.CheckSelection(profiles, selected)
+}
+
+// TemplateOrder calls Merger.TemplateOrder of zero Merger.
+func TemplateOrder(lines []SectionLine, selected []string) []string {
+	return Merger{}.TemplateOrder(lines, selected)
+}
+
+// Contributions calls Merger.Contributions of zero Merger.
+func Contributions(lines []SectionLine, selected []string) []SectionLine {
+	return Merger{}.Contributions(lines, selected)
+}
+
+// Resolve calls Merger.Resolve of zero Merger.
+func Resolve(lines []SectionLine, selected []string) []SectionLine {
+	return Merger{}.Resolve(lines, selected)
+}
+
+// Provenance calls Merger.Provenance of zero Merger.
+func Provenance(lines []SectionLine, selected []string) []ResolvedSetting {
+	return Merger{}.Provenance(lines, selected)
+}
+
+// MergeWithProvenance calls Merger.MergeWithProvenance of zero Merger.
+func MergeWithProvenance(lines []SectionLine, selected []string) ([]ResolvedSetting, error) {
+	return Merger{}.MergeWithProvenance(lines, selected)
+}
+
+// Merge calls Merger.Merge of zero Merger.
+func Merge(lines []SectionLine, selected []string) (string, error) {
+	return Merger{}.Merge(lines, selected)
+}
+
+// MergeMap calls Merger.MergeMap of zero Merger.
+func MergeMap(profiles map[string][]KV, selected []string) ([]KV, error) {
+	return Merger{}.MergeMap(profiles, selected)
+}
+
+// profileParents maps profiles to profiles they extend.
+func profileParents(lines []SectionLine) map[string]string {
+	parents := make(map[string]string)
+	for _, sl := range lines {
+		if sl.Extends != "" {
+			parents[sl.Profile] = sl.Extends
+		}
+	}
+	return parents
+}
+
+// checkInheritance reports profiles extending unknown profiles and
+// inheritance cycles.
+func checkInheritance(lines []SectionLine, profiles []string) error {
+	parents := profileParents(lines)
+	for _, p := range profiles {
+		chain := []string{p}
+		for cur := p; parents[cur] != ""; cur = parents[cur] {
+			parent := parents[cur]
+			if slices.Index(profiles, parent) < 0 {
+				return fmt.Errorf("profile %q extends unknown profile %q", cur, parent)
+			}
+			chain = append(chain, parent)
+			if slices.Index(chain[:len(chain)-1], parent) >= 0 {
+				return fmt.Errorf("profile inheritance cycle: %s", strings.Join(chain, " -> "))
+			}
+		}
+	}
+	return nil
+}
+
+// expandInheritance replaces each profile with its inheritance chain,
+// from the topmost parent down to the profile itself.
+func expandInheritance(lines []SectionLine, selected []string) []string {
+	parents := profileParents(lines)
+	var expanded []string
+	for _, p := range selected {
+		chain := []string{p}
+		for cur := p; parents[cur] != ""; cur = parents[cur] {
+			chain = append([]string{parents[cur]}, chain...)
+		}
+		expanded = append(expanded, chain...)
+	}
+	return expanded
+}
+
+// FilterHost returns lines without settings of profiles restricted to hosts
+// other than hostname by 'host' directives, along with names of such
+// profiles. Host names are compared ignoring case.
+func FilterHost(lines []SectionLine, hostname string) ([]SectionLine, []string) {
+	restricted := make(map[string]bool) // profile -> allowed on hostname
+	for _, sl := range lines {
+		if sl.Host != "" {
+			restricted[sl.Profile] = restricted[sl.Profile] || strings.EqualFold(sl.Host, hostname)
+		}
+	}
+
+	var skipped []string
+	for p, allowed := range restricted {
+		if !allowed {
+			skipped = append(skipped, p)
+		}
+	}
+	slices.Sort(skipped)
+
+	filtered := make([]SectionLine, 0, len(lines))
+	for _, sl := range lines {
+		if !sl.IsSetting() || slices.Index(skipped, sl.Profile) < 0 {
+			filtered = append(filtered, sl)
+		}
+	}
+	return filtered, skipped
+}
+
+// ExpandPatterns replaces glob patterns in selected, as understood by
+// path.Match, with profiles matching them, in sorted order. It's an error
+// for a pattern to match no profiles.
+func ExpandPatterns(profiles, selected []string) ([]string, error) {
+	var expanded []string
+	for _, p := range selected {
+		if !strings.ContainsAny(p, "*?[") {
+			expanded = append(expanded, p)
+			continue
+		}
+		matched := false
+		for _, profile := range profiles {
+			ok, err := path.Match(p, profile)
+			if err != nil {
+				return nil, fmt.Errorf("malformed profile pattern %q: %v", p, err)
+			}
+			if ok {
+				expanded = append(expanded, profile)
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("pattern %q matches no profiles", p)
+		}
+	}
+	return expanded, nil
+}
+
+// CheckSelection reports selected profiles missing from profiles, profiles
+// selected more than once, and default profile selected anywhere but first.
+func (m Merger) CheckSelection(profiles, selected []string) error {
+	if lastIndex(selected, m.defaultName()) > 0 {
+		return fmt.Errorf("default profile must be the only, or the first of many selections.\n\tGot %q",
+			strings.Join(selected, ","))
+	}
+	for i, p := range selected {
+		if slices.Index(profiles, p) < 0 {
+			return fmt.Errorf("profile does not exist in template: %s", p)
+		}
+		if slices.Index(selected[:i], p) >= 0 {
+			return fmt.Errorf("profile %s is selected more than once, it would only be applied the first time", p)
+		}
+	}
+	return nil
+}
+
+// lastIndex returns index of the last occurrence of v in s, or -1 if v is not
+// present.
+func lastIndex[S ~[]E, E comparable](s S, v E) int {
+	for i := len(s) - 1; i >= 0; i-- {
+		if v == s[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// TemplateOrder returns selected profiles sorted in order their first lines
+// appear in template lines, so that profiles defined later in template
+// override earlier ones regardless of selection order. Default profile stays
+// first, profiles without lines keep their relative order at the end.
+func (m Merger) TemplateOrder(lines []SectionLine, selected []string) []string {
+	first := make(map[string]int)
+	for idx, sl := range lines {
+		if _, ok := first[sl.Profile]; !ok && sl.Alias == "" && sl.Group == "" {
+			first[sl.Profile] = idx
+		}
+	}
+	position := func(p string) int {
+		if p == m.defaultName() {
+			return -1
+		}
+		if idx, ok := first[p]; ok {
+			return idx
+		}
+		return len(lines)
+	}
+	ordered := slices.Clone(selected)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		return position(a) - position(b)
+	})
+	return ordered
+}
+
+// Contributions returns settings of selected profiles in order they are
+// applied, including ones overridden by later profiles. Default profile is
+// always applied first, inherited profiles are applied before their
+// children.
+func (m Merger) Contributions(lines []SectionLine, selected []string) []SectionLine {
+	if len(selected) > 0 && selected[0] == m.defaultName() {
+		selected = selected[1:]
+	}
+
+	byProfile := make(map[string][]SectionLine)
+	for _, sl := range lines {
+		if sl.IsSetting() {
+			byProfile[sl.Profile] = append(byProfile[sl.Profile], sl)
+		}
+	}
+
+	// Each profile is applied once, at its first position, even if it's
+	// selected again or inherited by several selected profiles.
+	settings := make([]SectionLine, 0)
+	applied := make(map[string]bool)
+	for _, profile := range expandInheritance(lines, append([]string{m.defaultName()}, selected...)) {
+		if applied[profile] {
+			continue
+		}
+		applied[profile] = true
+		settings = append(settings, byProfile[profile]...)
+	}
+	return settings
+}
+
+// Resolve returns settings which win the merge of selected profiles, in
+// order they are applied. Unset keys are omitted. Values of appending
+// settings are combined with the values they are appended to, and are not
+// raw then.
+func (m Merger) Resolve(lines []SectionLine, selected []string) []SectionLine {
+	settings := m.Contributions(lines, selected)
+	settingIdx := make(map[string]int, len(settings))
+	values := make(map[string]string, len(settings))
+	for idx, sl := range settings {
+		settingIdx[sl.Setting.Key] = idx
+		prev, ok := values[sl.Setting.Key]
+		switch {
+		case sl.Unset:
+			delete(values, sl.Setting.Key)
+		case sl.Append && ok:
+			values[sl.Setting.Key] = AppendList(prev, sl.Setting.Value)
+		case sl.Append:
+			values[sl.Setting.Key] = AppendList("", sl.Setting.Value)
+		default:
+			values[sl.Setting.Key] = sl.Setting.Value
+		}
+	}
+
+	resolved := make([]SectionLine, 0, len(settingIdx))
+	for idx, sl := range settings {
+		if settingIdx[sl.Setting.Key] == idx && !sl.Unset {
+			sl.Setting.Value = values[sl.Setting.Key]
+			resolved = append(resolved, sl)
+		}
+	}
+	return resolved
+}
+
+// AppendList appends space-separated entries to list value, skipping ones
+// already in it.
+func AppendList(value, entries string) string {
+	list := strings.Fields(value)
+	for _, e := range strings.Fields(entries) {
+		if slices.Index(list, e) < 0 {
+			list = append(list, e)
+		}
+	}
+	return strings.Join(list, " ")
+}
+
+// ResolvedSetting is a setting which wins the merge of selected profiles,
+// along with how it got its value.
+type ResolvedSetting struct {
+	Setting KV
+	// Profile is the profile which set, or appended to, the value last.
+	Profile string
+	// Contributors are lines of applied profiles setting, appending to or
+	// removing the key, in order they are applied, including overridden
+	// ones.
+	Contributors []SectionLine
+}
+
+// Provenance returns settings which win the merge of selected profiles, in
+// order they are applied, like Resolve, along with all lines contributing to
+// each of them.
+func (m Merger) Provenance(lines []SectionLine, selected []string) []ResolvedSetting {
+	contributors := make(map[string][]SectionLine)
+	for _, sl := range m.Contributions(lines, selected) {
+		contributors[sl.Setting.Key] = append(contributors[sl.Setting.Key], sl)
+	}
+	resolved := m.Resolve(lines, selected)
+	settings := make([]ResolvedSetting, 0, len(resolved))
+	for _, sl := range resolved {
+		settings = append(settings, ResolvedSetting{
+			Setting:      sl.Setting,
+			Profile:      sl.Profile,
+			Contributors: contributors[sl.Setting.Key],
+		})
+	}
+	return settings
+}
+
+// MergeWithProvenance merges selected profiles, aliases, groups or profile
+// patterns of template lines like Merge, returning settings along with their
+// provenance instead of config text.
+func (m Merger) MergeWithProvenance(lines []SectionLine, selected []string) ([]ResolvedSetting, error) {
+	selected, err := m.expandSelection(lines, selected)
+	if err != nil {
+		return nil, err
+	}
+	return m.Provenance(lines, selected), nil
+}
+
+// expandSelection replaces groups, aliases and patterns in selected with
+// profiles, and checks the result with CheckSelection.
+func (m Merger) expandSelection(lines []SectionLine, selected []string) ([]string, error) {
+	profiles := m.Profiles(lines)
+	selected, err := ExpandPatterns(profiles, ExpandAliases(lines, ExpandGroups(lines, selected)))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.CheckSelection(profiles, selected); err != nil {
+		return nil, err
+	}
+	return selected, nil
+}
+
+// Merge merges selected profiles, aliases, groups or profile patterns of
+// template lines into tlp config text, one KEY=VALUE per line.
+func (m Merger) Merge(lines []SectionLine, selected []string) (string, error) {
+	selected, err := m.expandSelection(lines, selected)
+	if err != nil {
+		return "", err
+	}
+
+	sb := strings.Builder{}
+	for _, sl := range m.Resolve(lines, selected) {
+		fmt.Fprintf(&sb, "%s=%s\n", sl.Setting.Key, sl.ConfigValue())
+	}
+	return sb.String(), nil
+}
+
+// MergeMap merges selected profiles of already parsed settings, keyed by
+// profile name, without a template. Default profile, if present, is always
+// applied first, and can only be selected as the first one. Settings which
+// win the merge are returned in order they are applied, each key once.
+func (m Merger) MergeMap(profiles map[string][]KV, selected []string) ([]KV, error) {
+	names := []string{m.defaultName()}
+	for p := range profiles {
+		if p != m.defaultName() {
+			names = append(names, p)
+		}
+	}
+	slices.Sort(names[1:])
+	if err := m.CheckSelection(names, selected); err != nil {
+		return nil, err
+	}
+
+	var lines []SectionLine
+	for _, p := range names {
+		for _, kv := range profiles[p] {
+			lines = append(lines, SectionLine{Profile: p, Setting: kv})
+		}
+	}
+	resolved := m.Resolve(lines, selected)
+	settings := make([]KV, 0, len(resolved))
+	for _, sl := range resolved {
+		settings = append(settings, sl.Setting)
+	}
+	return settings, nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLastIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		s    []string
+		v    string
+		want int
+	}{
+		{"single element", []string{"default"}, "default", 0},
+		{"match at index 0", []string{"default", "ac", "bat"}, "default", 0},
+		{"last of many", []string{"ac", "default", "bat", "default"}, "default", 3},
+		{"no match", []string{"ac", "bat"}, "default", -1},
+		{"empty", nil, "default", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lastIndex(tt.s, tt.v); got != tt.want {
+				t.Errorf("lastIndex(%q, %q) = %d, want %d", tt.s, tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSelectionDefaultFirst(t *testing.T) {
+	profiles := []string{DefaultProfile, "ac", "bat"}
+	tests := []struct {
+		selected []string
+		wantErr  bool
+	}{
+		{[]string{DefaultProfile}, false},
+		{[]string{DefaultProfile, "ac"}, false},
+		{[]string{"ac", DefaultProfile}, true},
+		{[]string{"ac", "bat"}, false},
+	}
+	for _, tt := range tests {
+		if err := CheckSelection(profiles, tt.selected); (err != nil) != tt.wantErr {
+			t.Errorf("CheckSelection(%q) error = %v, want error %v", tt.selected, err, tt.wantErr)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	lines := []SectionLine{
+		{Profile: DefaultProfile, Setting: KV{"TLP_ENABLE", "1"}},
+		{Profile: DefaultProfile, Setting: KV{"USB_DENYLIST", "1234:5678"}},
+		{Profile: "ac", Setting: KV{"TLP_ENABLE", "0"}},
+		{Profile: "ac", Setting: KV{"USB_DENYLIST", "abcd:ef01"}, Append: true},
+		{Profile: "bat", Setting: KV{"TLP_ENABLE", ""}, Unset: true},
+	}
+	tests := []struct {
+		selected []string
+		want     []KV
+	}{
+		{nil, []KV{{"TLP_ENABLE", "1"}, {"USB_DENYLIST", "1234:5678"}}},
+		{[]string{"ac"}, []KV{{"TLP_ENABLE", "0"}, {"USB_DENYLIST", "1234:5678 abcd:ef01"}}},
+		{[]string{"ac", "bat"}, []KV{{"USB_DENYLIST", "1234:5678 abcd:ef01"}}},
+	}
+	for _, tt := range tests {
+		var got []KV
+		for _, sl := range Resolve(lines, tt.selected) {
+			got = append(got, sl.Setting)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Resolve(%q) = %v, want %v", tt.selected, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkResolve(b *testing.B) {
+	var lines []SectionLine
+	var selected []string
+	for p := 0; p < 50; p++ {
+		profile := fmt.Sprintf("profile%d", p)
+		selected = append(selected, profile)
+		for k := 0; k < 200; k++ {
+			lines = append(lines, SectionLine{Profile: profile, Setting: KV{fmt.Sprintf("KEY_%d", k), profile}})
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Resolve(lines, selected)
+	}
+}
+
+func TestMergerDefaultName(t *testing.T) {
+	text := "TLP_ENABLE=1\n[ac]\nTLP_ENABLE=0\n[base]\nCPU_BOOST_ON_AC=1\n"
+	lines, err := (&Parser{DefaultName: "base"}).Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := Merger{DefaultName: "base"}
+	if got, want := m.Profiles(lines), []string{"base", "ac"}; !slices.Equal(got, want) {
+		t.Errorf("Profiles() = %q, want %q", got, want)
+	}
+	got, err := m.Merge(lines, []string{"ac"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "CPU_BOOST_ON_AC=1\nTLP_ENABLE=0\n"; got != want {
+		t.Errorf("Merge() = %q, want %q", got, want)
+	}
+	if _, err := m.Merge(lines, []string{"ac", "base"}); err == nil {
+		t.Error("default profile selected after another one is accepted")
+	}
+	// Package functions still use DefaultProfile.
+	if _, err := Merge(lines, []string{"ac", "base"}); err != nil {
+		t.Errorf("Merge() with DefaultProfile: %v", err)
+	}
+}
+
+func TestMergerFoldCase(t *testing.T) {
+	lines := []SectionLine{
+		{Profile: "base", Setting: KV{"TLP_ENABLE", "1"}},
+		{Profile: "Default", Setting: KV{"TLP_ENABLE", "0"}},
+		{Profile: "AC", Setting: KV{"TLP_ENABLE", "0"}},
+	}
+	got := Merger{DefaultName: "base"}.FoldCase(lines, []string{"default", "ac", "BASE"})
+	if want := []string{"Default", "AC", "base"}; !slices.Equal(got, want) {
+		t.Errorf("FoldCase() = %q, want %q", got, want)
+	}
+}
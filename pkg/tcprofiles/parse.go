@@ -0,0 +1,762 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var sectionRegex = regexp.MustCompile(`^\[.*\]$`)
+var validSectionNameRegex = regexp.MustCompile(`^\w[\w.-]*$`)
+var extendsRegex = regexp.MustCompile(`^extends\s*=\s*(.+)$`)
+var hostRegex = regexp.MustCompile(`^host\s*=\s*(.+)$`)
+var envRegex = regexp.MustCompile(`\$\{(\w+)(:-[^}]*)?\}`)
+var includeRegex = regexp.MustCompile(`^include\s+(.+)$`)
+var descriptionRegex = regexp.MustCompile(`^#\s*description:\s*(.+)$`)
+
+// keyPatterns are regexes of lines containing keys.
+type keyPatterns struct {
+	keyVal, whitespaceKeyVal, append, unset, raw, enable *regexp.Regexp
+}
+
+// newKeyPatterns returns regexes of lines with keys matching key regex.
+func newKeyPatterns(key string) *keyPatterns {
+	return &keyPatterns{
+		keyVal:           regexp.MustCompile(`^(` + key + `)[ \t]*=[ \t]*(.+)$`),
+		whitespaceKeyVal: regexp.MustCompile(`^(` + key + `)[ \t]+(.+)$`),
+		append:           regexp.MustCompile(`^(` + key + `)[ \t]*\+=[ \t]*(.+)$`),
+		unset:            regexp.MustCompile(`^!(` + key + `)$`),
+		raw:              regexp.MustCompile(`^raw\s+(` + key + `(?:[\s,]+` + key + `)*)$`),
+		enable:           regexp.MustCompile(`^enable\s+(` + key + `)$`),
+	}
+}
+
+var (
+	standardKeys = newKeyPatterns(`\w+`)
+	extendedKeys = newKeyPatterns(`\w[\w.-]*`)
+)
+var aliasRegex = regexp.MustCompile(`^\[alias\s+(.+?)\s*=\s*(.+?)\]$`)
+var groupRegex = regexp.MustCompile(`^\[group:\s*(.+?)\s*\]\s*=\s*(.+)$`)
+
+// SyntaxError is an error in a template line, pointing at the column where
+// the line stopped making sense.
+type SyntaxError struct {
+	Msg    string
+	Text   string // text of the line, without surrounding whitespace
+	Column int    // 1-based byte column in Text
+}
+
+func (e *SyntaxError) Error() string {
+	return e.Msg
+}
+
+// LineError is an error in a template line, errors returned by Parser for
+// lines of template are wrapped in it. Line is 1-based, File is empty for
+// template read by Parse. Error message contains the position already.
+type LineError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Parser parses templates. Zero value is ready to use.
+type Parser struct {
+	// Strict makes warnings errors.
+	Strict bool
+	// CheckKeys makes keys unknown to tlp warnings.
+	CheckKeys bool
+	// AllowWhitespace makes a tab or a run of spaces a separator of key and
+	// value too, as in 'KEY<tab>VALUE'.
+	AllowWhitespace bool
+	// CheckValues makes values invalid for their tlp settings warnings, see
+	// CheckValue.
+	CheckValues bool
+	// ExtendedKeys allows hyphens and dots in keys after the first
+	// character, as used by some third-party drop-ins.
+	ExtendedKeys bool
+	// Warn is called for each non-fatal template issue, if set.
+	Warn func(msg string)
+	// LookupEnv, if set, is used to expand ${VAR} and ${VAR:-default} in
+	// values, e.g. os.LookupEnv. Variables without default must be set
+	// unless AllowUnsetEnv is true, they expand to empty string then.
+	// Names profile and hostname are built-in variables instead: ${profile}
+	// expands to the profile the value belongs to, ${hostname} to Hostname,
+	// which must be set then.
+	LookupEnv     func(name string) (string, bool)
+	AllowUnsetEnv bool
+	Hostname      string
+	// AllErrors makes parsing continue after malformed lines, and warnings
+	// with Strict, to report all of them at once. The returned error then
+	// joins errors of all such lines, as errors.Join does. Relations
+	// between profiles are only checked if there are none.
+	AllErrors bool
+	// DefaultName is the name of the profile of settings before the first
+	// section, DefaultProfile if empty.
+	DefaultName string
+	// MaxLineLength, if positive, makes lines longer than that many
+	// characters warnings, as they may be lines joined by mistake.
+	MaxLineLength int
+}
+
+// Parse parses template from r with default Parser.
+func Parse(r io.Reader) ([]SectionLine, error) {
+	return (&Parser{}).Parse(r)
+}
+
+// ValidProfileName reports whether name can be used as a profile name.
+func ValidProfileName(name string) bool {
+	return validSectionNameRegex.MatchString(name)
+}
+
+// IsSettingLine reports whether line is a well-formed KEY=VALUE line, spaces
+// or tabs around '=' are allowed.
+func IsSettingLine(line string) bool {
+	return standardKeys.keyVal.MatchString(line)
+}
+
+func (p *Parser) defaultName() string {
+	if p.DefaultName == "" {
+		return DefaultProfile
+	}
+	return p.DefaultName
+}
+
+func (p *Parser) warn(msg string) error {
+	if p.Strict {
+		return errors.New(msg)
+	}
+	if p.Warn != nil {
+		p.Warn(msg)
+	}
+	return nil
+}
+
+// maxIncludeDepth limits nesting of included templates.
+const maxIncludeDepth = 10
+
+// parseState is shared by all files parsed as a single template.
+type parseState struct {
+	lines    []SectionLine
+	keyLines map[string]map[string]string // profile -> key -> position
+	files    []string                     // chain of files being included
+	top      string                       // top-level template file
+	rawKeys  map[string]bool              // keys with values taken as is
+	keys     *keyPatterns
+	// disabled holds text of the last commented-out setting line of each
+	// key, per profile, for 'enable' directives.
+	disabled map[string]map[string]string
+}
+
+// Parse parses template from r. It returns an error on the first malformed
+// line, or on issues with profile inheritance. Included files are resolved
+// relative to the current directory.
+func (p *Parser) Parse(r io.Reader) ([]SectionLine, error) {
+	st := &parseState{keyLines: make(map[string]map[string]string)}
+	if err := p.parse(r, "", p.defaultName(), st); err != nil {
+		return nil, err
+	}
+	return p.finish(st)
+}
+
+// ParseFile parses template file at path. Included files are resolved
+// relative to the directory of the file including them.
+func (p *Parser) ParseFile(path string) ([]SectionLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st := &parseState{keyLines: make(map[string]map[string]string), top: path}
+	if err := p.parseFile(f, path, st); err != nil {
+		return nil, err
+	}
+	return p.finish(st)
+}
+
+// ParseFiles parses template files at paths as one template, in the given
+// order. Sections with the same name in different files are combined, so
+// settings from later files override earlier ones. Duplicate keys are only
+// reported within a single file.
+func (p *Parser) ParseFiles(paths ...string) ([]SectionLine, error) {
+	st := &parseState{}
+	var errs []error
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		st.keyLines = make(map[string]map[string]string)
+		err = p.parseFile(f, path, st)
+		f.Close()
+		if err != nil && !p.AllErrors {
+			return nil, err
+		}
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return p.finish(st)
+}
+
+// parseFile parses top-level template file f, read from path.
+func (p *Parser) parseFile(f *os.File, path string, st *parseState) error {
+	if abs, err := filepath.Abs(path); err == nil {
+		st.files = []string{abs}
+	}
+	return p.parse(f, path, p.defaultName(), st)
+}
+
+// finish checks relations between profiles of the parsed template.
+func (p *Parser) finish(st *parseState) ([]SectionLine, error) {
+	profiles := Merger{DefaultName: p.DefaultName}.Profiles(st.lines)
+	if err := checkInheritance(st.lines, profiles); err != nil {
+		return nil, err
+	}
+	if err := checkAliases(st.lines, profiles); err != nil {
+		return nil, err
+	}
+	if err := checkGroups(st.lines, profiles); err != nil {
+		return nil, err
+	}
+	return st.lines, nil
+}
+
+// position describes line of file for messages. File is omitted for the
+// top-level template, if there is a single one.
+func (st *parseState) position(file string, lineNum int) string {
+	if file != st.top {
+		return fmt.Sprintf("%s line %d", file, lineNum)
+	}
+	return fmt.Sprintf("line %d", lineNum)
+}
+
+// include parses file at path, relative to directory of file, as part of the
+// template. Lines before the first section of the file belong to profile,
+// the section of the include line.
+func (p *Parser) include(path, file, profile string, st *parseState) error {
+	if !filepath.IsAbs(path) && file != "" {
+		path = filepath.Join(filepath.Dir(file), path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if i := slices.Index(st.files, abs); i >= 0 {
+		return fmt.Errorf("include cycle: %s", strings.Join(append(st.files[i:], abs), " -> "))
+	}
+	if len(st.files) > maxIncludeDepth {
+		return fmt.Errorf("includes are nested deeper than %d levels", maxIncludeDepth)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("%v", err)
+	}
+	defer f.Close()
+
+	st.files = append(st.files, abs)
+	defer func() { st.files = st.files[:len(st.files)-1] }()
+	return p.parse(f, path, profile, st)
+}
+
+// parse parses template from r, read from file, appending its lines to st.
+// Lines before the first section belong to profile.
+func (p *Parser) parse(r io.Reader, file, profile string, st *parseState) (err error) {
+	lineNum := 0
+	defer func() {
+		var le *LineError
+		if err != nil && !errors.As(err, &le) {
+			err = &LineError{File: file, Line: lineNum, Err: err}
+		}
+	}()
+	if st.keys == nil {
+		st.keys = standardKeys
+		if p.ExtendedKeys {
+			st.keys = extendedKeys
+		}
+	}
+	bf := bufio.NewReader(r)
+
+	curProfile := profile
+	sectionStarted := false
+	// Lines after a malformed section header are skipped until the next one,
+	// they don't belong to the previous section.
+	skipSection := false
+	var comment []string
+	headers := make(map[string]string) // profile -> position of its header in file
+	var lineErrs []error
+	for {
+		lineNum++
+		line, err := bf.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("template read %s error: %v", st.position(file, lineNum), err)
+		}
+
+		if lineNum == 1 {
+			// Editors on Windows may start UTF-8 files with a byte order mark.
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+		untrimmed := strings.TrimRight(line, "\r\n")
+		if n := utf8.RuneCountInString(untrimmed); p.MaxLineLength > 0 && n > p.MaxLineLength {
+			msg := fmt.Sprintf("%s is %d characters long, more than %d", st.position(file, lineNum), n, p.MaxLineLength)
+			if err := p.warn(msg); err != nil {
+				if !p.AllErrors {
+					return err
+				}
+				lineErrs = append(lineErrs, &LineError{File: file, Line: lineNum, Err: err})
+			}
+		}
+		// TrimSpace drops '\r' of CRLF line endings too, so that templates
+		// edited on Windows don't get it in values. Indented comments,
+		// including a bare '#' after whitespace, are recognized after it.
+		line = strings.TrimSpace(line)
+		if skipSection && !sectionRegex.MatchString(line) {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			continue
+		}
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			if descMatches := descriptionRegex.FindStringSubmatch(line); descMatches != nil {
+				// Descriptions are metadata, not comments of settings.
+				st.lines = append(st.lines, SectionLine{Profile: curProfile, Description: descMatches[1],
+					File: file, LineNum: lineNum})
+			} else if len(line) == 0 {
+				comment = nil
+			} else {
+				// tlp only understands '#' comments.
+				comment = append(comment, "#"+line[1:])
+				if line[0] == '#' {
+					st.disable(curProfile, line[1:])
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			continue
+		}
+		pos := st.position(file, lineNum)
+		// Errors of a line are collected with AllErrors, the rest of the line
+		// is skipped then.
+		lineErr := func() error {
+			if enMatches := st.keys.enable.FindStringSubmatch(line); enMatches != nil {
+				// The commented-out setting is parsed in place of the directive.
+				text, ok := st.enabled(curProfile, enMatches[1])
+				if !ok {
+					return fmt.Errorf("no commented-out setting of %s to enable at %s", enMatches[1], pos)
+				}
+				line, untrimmed = text, text
+			}
+			if incMatches := includeRegex.FindStringSubmatch(line); incMatches != nil {
+				path, err := unquoteValue(incMatches[1])
+				if err != nil {
+					return fmt.Errorf("malformed include at %s: %v", pos, err)
+				}
+				if err := p.include(path, file, curProfile, st); err != nil {
+					return fmt.Errorf("include at %s: %w", pos, err)
+				}
+				comment = nil
+			} else if rawMatches := st.keys.raw.FindStringSubmatch(line); rawMatches != nil {
+				if st.rawKeys == nil {
+					st.rawKeys = make(map[string]bool)
+				}
+				for _, key := range strings.FieldsFunc(rawMatches[1], func(r rune) bool {
+					return r == ',' || unicode.IsSpace(r)
+				}) {
+					st.rawKeys[key] = true
+				}
+				comment = nil
+			} else if aliasMatches := aliasRegex.FindStringSubmatch(line); aliasMatches != nil {
+				alias, target := aliasMatches[1], aliasMatches[2]
+				if !validSectionNameRegex.MatchString(alias) || !validSectionNameRegex.MatchString(target) {
+					return fmt.Errorf("malformed alias definition at %s: %s", pos, line)
+				}
+				st.lines = append(st.lines, SectionLine{Profile: alias, Alias: target, File: file, LineNum: lineNum})
+				comment = nil
+			} else if groupMatches := groupRegex.FindStringSubmatch(line); groupMatches != nil {
+				group := groupMatches[1]
+				if !validSectionNameRegex.MatchString(group) || group == p.defaultName() {
+					return fmt.Errorf("malformed group name %q at %s", group, pos)
+				}
+				for _, member := range strings.Split(groupMatches[2], ",") {
+					if member = strings.TrimSpace(member); !validSectionNameRegex.MatchString(member) {
+						return fmt.Errorf("malformed group member %q at %s: %s", member, pos, line)
+					}
+					st.lines = append(st.lines, SectionLine{Profile: group, Group: member, File: file, LineNum: lineNum})
+				}
+				comment = nil
+			} else if sectionRegex.MatchString(line) {
+				name := line[1 : len(line)-1]
+				if skipSection = !validSectionNameRegex.MatchString(name); skipSection {
+					return fmt.Errorf("malformed section name %q at %s. Latin letters, digits, underscores, hyphens "+
+						"and dots only, starting with letter, digit or underscore", name, pos)
+				}
+				if prev, ok := headers[name]; ok {
+					if err := p.warn(fmt.Sprintf("duplicate section [%s] at %s and %s", name, prev, pos)); err != nil {
+						return err
+					}
+				}
+				headers[name] = pos
+				curProfile = name
+				sectionStarted = false
+			} else if hostMatches := hostRegex.FindStringSubmatch(line); hostMatches != nil {
+				if curProfile == p.defaultName() {
+					return fmt.Errorf("default profile can't be restricted to hosts, %s", pos)
+				}
+				for _, host := range strings.Split(hostMatches[1], ",") {
+					if host = strings.TrimSpace(host); host == "" {
+						return fmt.Errorf("empty host name at %s: %s", pos, line)
+					}
+					st.lines = append(st.lines, SectionLine{Profile: curProfile, Host: host, File: file, LineNum: lineNum})
+				}
+				comment = nil
+			} else if extMatches := extendsRegex.FindStringSubmatch(line); extMatches != nil {
+				parent := extMatches[1]
+				switch {
+				case curProfile == p.defaultName():
+					return fmt.Errorf("default profile can't extend other profiles, %s", pos)
+				case sectionStarted:
+					return fmt.Errorf("extends must be the first line of section, %s", pos)
+				case !validSectionNameRegex.MatchString(parent):
+					return fmt.Errorf("malformed profile name %q in extends at %s", parent, pos)
+				}
+				st.lines = append(st.lines, SectionLine{Profile: curProfile, Extends: parent, File: file, LineNum: lineNum})
+				sectionStarted = true
+			} else {
+				sl := SectionLine{Profile: curProfile, Comment: strings.Join(comment, "\n"), File: file, LineNum: lineNum}
+				comment = nil
+				if i := strings.IndexByte(line, '\r'); i >= 0 {
+					// A carriage return not ending the line would break the
+					// line in config.
+					return &SyntaxError{Msg: fmt.Sprintf("carriage return inside line at template %s", pos),
+						Text: line, Column: i + 1}
+				}
+				if unsetMatches := st.keys.unset.FindStringSubmatch(line); unsetMatches != nil {
+					sl.Setting.Key = unsetMatches[1]
+					sl.Unset = true
+				} else {
+					kvMatches := st.keys.keyVal.FindStringSubmatch(line)
+					if appendMatches := st.keys.append.FindStringSubmatch(line); appendMatches != nil {
+						kvMatches = appendMatches
+						sl.Append = true
+					} else if kvMatches == nil && p.AllowWhitespace {
+						kvMatches = st.keys.whitespaceKeyVal.FindStringSubmatch(line)
+					}
+					if len(kvMatches) < 3 {
+						return &SyntaxError{Msg: fmt.Sprintf("malformed template %s: %s", pos, line),
+							Text: line, Column: settingErrorColumn(line, p.ExtendedKeys)}
+					}
+					if i := strings.Index(untrimmed, "="); st.rawKeys[kvMatches[1]] && i >= 0 {
+						// Raw values are taken as is, up to the end of line.
+						sl.Setting = KV{Key: kvMatches[1], Value: untrimmed[i+1:]}
+						sl.Raw = !sl.Append
+					} else {
+						value := stripInlineComment(kvMatches[2])
+						if value == "" {
+							return &SyntaxError{Msg: fmt.Sprintf("empty value at template %s: %s", pos, line),
+								Text: line, Column: len(line) - len(kvMatches[2]) + 1}
+						}
+						value, err := unquoteValue(value)
+						if err != nil {
+							return fmt.Errorf("malformed template %s: %v", pos, err)
+						}
+						if p.LookupEnv != nil {
+							if value, err = p.expandEnv(value, curProfile); err != nil {
+								return fmt.Errorf("template %s: %v", pos, err)
+							}
+						}
+						sl.Setting = KV{Key: kvMatches[1], Value: value}
+					}
+				}
+				key := sl.Setting.Key
+				if st.keyLines[curProfile] == nil {
+					st.keyLines[curProfile] = make(map[string]string)
+				}
+				if prev, ok := st.keyLines[curProfile][key]; ok && !sl.Append {
+					err := p.warn(fmt.Sprintf("duplicate key %s in profile %q at %s and %s", key, curProfile, prev, pos))
+					if err != nil {
+						return err
+					}
+				}
+				st.keyLines[curProfile][key] = pos
+				if replacement, ok := ReplacementKey(key); ok {
+					msg := fmt.Sprintf("deprecated key %s in profile %q at %s, use %s instead", key, curProfile, pos, replacement)
+					if err := p.warn(msg); err != nil {
+						return err
+					}
+				} else if p.CheckKeys && !KnownKey(key) {
+					msg := fmt.Sprintf("unknown key %s in profile %q at %s", key, curProfile, pos)
+					if suggestion := SuggestKey(key); suggestion != "" {
+						msg += fmt.Sprintf(", did you mean %s?", suggestion)
+					}
+					if err := p.warn(msg); err != nil {
+						return err
+					}
+				}
+				if p.CheckValues && !sl.Unset && !sl.Append {
+					if err := CheckValue(key, sl.Setting.Value); err != nil {
+						if err := p.warn(fmt.Sprintf("%v (profile %q, %s)", err, curProfile, pos)); err != nil {
+							return err
+						}
+					}
+				}
+				st.lines = append(st.lines, sl)
+				sectionStarted = true
+			}
+			return nil
+		}()
+		if lineErr != nil {
+			var le *LineError
+			if !errors.As(lineErr, &le) {
+				lineErr = &LineError{File: file, Line: lineNum, Err: lineErr}
+			}
+			if !p.AllErrors {
+				return lineErr
+			}
+			lineErrs = append(lineErrs, lineErr)
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	return errors.Join(lineErrs...)
+}
+
+// disable remembers text of a commented-out line of profile, without '#', if
+// it is a setting like '#KEY=VALUE'.
+func (st *parseState) disable(profile, text string) {
+	matches := st.keys.keyVal.FindStringSubmatch(text)
+	if matches == nil {
+		matches = st.keys.append.FindStringSubmatch(text)
+	}
+	if matches == nil {
+		return
+	}
+	if st.disabled == nil {
+		st.disabled = make(map[string]map[string]string)
+	}
+	for _, p := range []string{profile, ""} {
+		if st.disabled[p] == nil {
+			st.disabled[p] = make(map[string]string)
+		}
+		st.disabled[p][matches[1]] = text
+	}
+}
+
+// enabled returns text of the last commented-out setting of key in profile,
+// or anywhere in the template before if profile has none.
+func (st *parseState) enabled(profile, key string) (string, bool) {
+	if text, ok := st.disabled[profile][key]; ok {
+		return text, true
+	}
+	text, ok := st.disabled[""][key]
+	return text, ok
+}
+
+// settingErrorColumn returns 1-based column of the first character of
+// malformed setting line which can't be a part of its key, or where '=' is
+// missing. Hyphens and dots after the first character are a part of extended
+// keys.
+func settingErrorColumn(line string, extended bool) int {
+	for i, r := range line {
+		if extended && i > 0 && (r == '-' || r == '.') {
+			continue
+		}
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return i + 1
+		}
+	}
+	return len(line) + 1
+}
+
+// expandEnv replaces ${VAR} and ${VAR:-default} in value of profile with
+// values of environment variables, or built-in variables.
+func (p *Parser) expandEnv(value, profile string) (string, error) {
+	var err error
+	expanded := envRegex.ReplaceAllStringFunc(value, func(m string) string {
+		sm := envRegex.FindStringSubmatch(m)
+		name, def := sm[1], sm[2]
+		if name == "profile" || name == "hostname" {
+			switch {
+			case err != nil:
+			case def != "":
+				err = fmt.Errorf("built-in variable %s can't have a default", name)
+			case name == "profile":
+				return profile
+			case p.Hostname != "":
+				return p.Hostname
+			default:
+				err = errors.New("host name is unknown")
+			}
+			return ""
+		}
+		if v, ok := p.LookupEnv(name); ok && (v != "" || def == "") {
+			return v
+		}
+		if def != "" {
+			return def[2:]
+		}
+		if !p.AllowUnsetEnv && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+		return ""
+	})
+	return expanded, err
+}
+
+// checkAliases reports aliases clashing with profile names or other aliases,
+// and aliases of unknown profiles.
+func checkAliases(lines []SectionLine, profiles []string) error {
+	seen := make(map[string]int)
+	for _, sl := range lines {
+		if sl.Alias == "" {
+			continue
+		}
+		if prev, ok := seen[sl.Profile]; ok {
+			return fmt.Errorf("alias %q at line %d is already defined at line %d", sl.Profile, sl.LineNum, prev)
+		}
+		seen[sl.Profile] = sl.LineNum
+		if slices.Index(profiles, sl.Profile) >= 0 {
+			return fmt.Errorf("alias %q at line %d clashes with profile of the same name", sl.Profile, sl.LineNum)
+		}
+		if slices.Index(profiles, sl.Alias) < 0 {
+			return fmt.Errorf("alias %q at line %d points to unknown profile %q", sl.Profile, sl.LineNum, sl.Alias)
+		}
+	}
+	return nil
+}
+
+// checkGroups reports groups clashing with profile names, aliases or other
+// groups, groups of unknown profiles and cycles of groups.
+func checkGroups(lines []SectionLine, profiles []string) error {
+	aliases := Aliases(lines)
+	groups := Groups(lines)
+	seen := make(map[string]int)
+	for _, sl := range lines {
+		if sl.Group == "" {
+			continue
+		}
+		if prev, ok := seen[sl.Profile]; ok && prev != sl.LineNum {
+			return fmt.Errorf("group %q at line %d is already defined at line %d", sl.Profile, sl.LineNum, prev)
+		}
+		seen[sl.Profile] = sl.LineNum
+		if _, ok := aliases[sl.Profile]; ok || slices.Index(profiles, sl.Profile) >= 0 {
+			return fmt.Errorf("group %q at line %d clashes with profile or alias of the same name", sl.Profile, sl.LineNum)
+		}
+		_, isAlias := aliases[sl.Group]
+		_, isGroup := groups[sl.Group]
+		if !isAlias && !isGroup && slices.Index(profiles, sl.Group) < 0 {
+			return fmt.Errorf("group %q at line %d includes unknown profile %q", sl.Profile, sl.LineNum, sl.Group)
+		}
+	}
+
+	var visit func(group string, chain []string) error
+	visit = func(group string, chain []string) error {
+		if i := slices.Index(chain, group); i >= 0 {
+			return fmt.Errorf("group cycle: %s", strings.Join(append(chain[i:], group), " -> "))
+		}
+		for _, member := range groups[group] {
+			if err := visit(member, append(chain, group)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	names := make([]string, 0, len(groups))
+	for group := range groups {
+		names = append(names, group)
+	}
+	slices.Sort(names)
+	for _, group := range names {
+		if err := visit(group, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stripInlineComment cuts trailing comment, starting with '#' or ';' preceded
+// by whitespace, off value. '#' and ';' inside quotes are kept.
+func stripInlineComment(value string) string {
+	var quote rune
+	escaped := false
+	for i, r := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case (r == '#' || r == ';') && i > 0 && unicode.IsSpace(rune(value[i-1])):
+			return strings.TrimRightFunc(value[:i], unicode.IsSpace)
+		}
+	}
+	return value
+}
+
+// unquoteValue strips double or single quotes around value, unescaping
+// quotes and backslashes escaped with a backslash inside. Unquoted values
+// are returned as is.
+func unquoteValue(value string) (string, error) {
+	if len(value) == 0 || (value[0] != '"' && value[0] != '\'') {
+		return value, nil
+	}
+	quote := value[0]
+	if len(value) < 2 || value[len(value)-1] != quote {
+		return "", fmt.Errorf("unterminated quoted value %s", value)
+	}
+
+	sb := strings.Builder{}
+	inner := value[1 : len(value)-1]
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		switch {
+		case c == '\\' && i+1 < len(inner) && (inner[i+1] == quote || inner[i+1] == '\\'):
+			i++
+			sb.WriteByte(inner[i])
+		case c == '\\' && i+1 == len(inner):
+			return "", fmt.Errorf("unterminated quoted value %s", value)
+		case c == quote:
+			return "", fmt.Errorf("unescaped quote inside value %s", value)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
+
+// QuoteValue puts value in double quotes if it is empty or contains
+// whitespace, quotes or '#', escaping quotes and backslashes inside.
+func QuoteValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\"'#\\") {
+		return value
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(value) + `"`
+}
@@ -0,0 +1,297 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func FuzzParse(f *testing.F) {
+	seeds := []string{
+		"TLP_ENABLE=1\n[ac]\nTLP_ENABLE=0\n",
+		"TLP_ENABLE=1\r\n[ac]\r\nCPU_BOOST_ON_AC=1\r\n",
+		"\uFEFF[default]\nTLP_ENABLE=1\n",
+		"USB_DENYLIST=\"1234:5678 # not a comment\" # comment\nDISK_DEVICES='nvme0n1 sda'\n",
+		"raw USB_DENYLIST\nUSB_DENYLIST=  \"1234:5678\\\"  # keep\n",
+		"include missing.txt\n[ac]\nTLP_ENABLE=1\n",
+		"[alias a=ac]\n[group: mobile] = ac, bat\n[ac]\nTLP_ENABLE=1\n[bat]\nextends = ac\n",
+		"# description: base\nUSB_DENYLIST=1234:5678\n[ac]\nUSB_DENYLIST+=abcd:ef01\n!TLP_ENABLE\n",
+		"#TLP_ENABLE=1\nenable TLP_ENABLE\n[bat]\nhost = laptop\nTLP_ENABLE = 0 ; x\n",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		for _, line := range strings.Split(text, "\n") {
+			// Included files are opened, keep them in the package directory.
+			if m := includeRegex.FindStringSubmatch(strings.TrimSpace(line)); m != nil && strings.ContainsAny(m[1], `/\`) {
+				t.Skip()
+			}
+		}
+		lines, err := (&Parser{AllErrors: true}).Parse(strings.NewReader(text))
+		if err != nil {
+			return
+		}
+		selected := Profiles(lines)
+		if len(selected) > 4 {
+			selected = selected[:4]
+		}
+		resolved := Resolve(lines, selected)
+		for _, sl := range resolved {
+			if strings.ContainsAny(sl.Setting.Value, "\r\n") {
+				t.Errorf("value of %s contains line break: %q", sl.Setting.Key, sl.Setting.Value)
+			}
+		}
+		config, err := Merge(lines, selected)
+		if err != nil {
+			t.Fatalf("Merge(%q): %v", selected, err)
+		}
+		if n := strings.Count(config, "\n"); n != len(resolved) {
+			t.Errorf("Merge(%q) produced %d lines, want %d", selected, n, len(resolved))
+		}
+		settings, err := MergeWithProvenance(lines, selected)
+		if err != nil {
+			t.Fatalf("MergeWithProvenance(%q): %v", selected, err)
+		}
+		if len(settings) != len(resolved) {
+			t.Errorf("MergeWithProvenance(%q) returned %d settings, want %d", selected, len(settings), len(resolved))
+		}
+	})
+}
+
+// settings returns settings of template lines, or fails t if text can't be
+// parsed by p.
+func settings(t *testing.T, p *Parser, text string) []KV {
+	t.Helper()
+	lines, err := p.Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("Parse(%q): %v", text, err)
+	}
+	var kvs []KV
+	for _, sl := range lines {
+		if sl.IsSetting() {
+			kvs = append(kvs, sl.Setting)
+		}
+	}
+	return kvs
+}
+
+func TestParseInlineComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`CPU_SCALING_GOVERNOR=powersave # quieter fans`, "powersave"},
+		{`CPU_SCALING_GOVERNOR=powersave`, "powersave"},
+		{`USB_DENYLIST="1234:5678 # not a comment"`, "1234:5678 # not a comment"},
+		{`USB_DENYLIST="1234:5678 # not a comment" # a comment`, "1234:5678 # not a comment"},
+		{`USB_DENYLIST='#1234:5678'`, "#1234:5678"},
+	}
+	for _, tt := range tests {
+		got := settings(t, &Parser{}, tt.line+"\n")
+		if len(got) != 1 || got[0].Value != tt.want {
+			t.Errorf("%s: got %v, want value %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseCRLF(t *testing.T) {
+	text := "raw USB_DENYLIST\r\n" +
+		"TLP_ENABLE=1\r\n" +
+		"[ac]\r\n" +
+		"CPU_SCALING_GOVERNOR=performance # fast\r\n" +
+		"USB_DENYLIST=1234:5678 abcd:ef01\r\n"
+	want := []KV{
+		{"TLP_ENABLE", "1"},
+		{"CPU_SCALING_GOVERNOR", "performance"},
+		{"USB_DENYLIST", "1234:5678 abcd:ef01"},
+	}
+	got := settings(t, &Parser{}, text)
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, kv := range got {
+		if strings.ContainsRune(kv.Value, '\r') {
+			t.Errorf("value of %s contains carriage return: %q", kv.Key, kv.Value)
+		}
+	}
+}
+
+func TestParseMixedSeparators(t *testing.T) {
+	text := "TLP_ENABLE=1\n" +
+		"TLP_DEFAULT_MODE\tAC\n" +
+		"CPU_SCALING_GOVERNOR_ON_AC    performance\n" +
+		"CPU_SCALING_GOVERNOR_ON_BAT \t powersave # quiet\n" +
+		"USB_DENYLIST\t\"1234:5678 abcd:ef01\"\n"
+	want := []KV{
+		{"TLP_ENABLE", "1"},
+		{"TLP_DEFAULT_MODE", "AC"},
+		{"CPU_SCALING_GOVERNOR_ON_AC", "performance"},
+		{"CPU_SCALING_GOVERNOR_ON_BAT", "powersave"},
+		{"USB_DENYLIST", "1234:5678 abcd:ef01"},
+	}
+	if got := settings(t, &Parser{AllowWhitespace: true}, text); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := Parse(strings.NewReader(text)); err == nil {
+		t.Error("whitespace separators are accepted without AllowWhitespace")
+	}
+}
+
+func TestMergeRawValue(t *testing.T) {
+	text := "raw USB_DENYLIST\n" +
+		"USB_DENYLIST=  \"1234:5678 abcd:ef01\"  # keep\n" +
+		"TLP_DEFAULT_MODE=\"AC\"\n"
+	lines, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Merge(lines, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "USB_DENYLIST=  \"1234:5678 abcd:ef01\"  # keep\nTLP_DEFAULT_MODE=AC\n"
+	if got != want {
+		t.Errorf("Merge() = %q, want %q", got, want)
+	}
+}
+
+func TestParseIndentedComments(t *testing.T) {
+	text := "TLP_ENABLE=1\n" +
+		"   # x\n" +
+		"\t;x\n" +
+		"  \t \n" +
+		"#\n" +
+		"    #\n" +
+		"[ac]\n" +
+		"\t# CPU_SCALING_GOVERNOR_ON_AC=powersave\n" +
+		"CPU_SCALING_GOVERNOR_ON_AC=performance\n"
+	want := []KV{
+		{"TLP_ENABLE", "1"},
+		{"CPU_SCALING_GOVERNOR_ON_AC", "performance"},
+	}
+	if got := settings(t, &Parser{}, text); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseSpacesAroundEquals(t *testing.T) {
+	tests := []string{
+		"TLP_ENABLE=1",
+		"TLP_ENABLE = 1",
+		"TLP_ENABLE =1",
+		"TLP_ENABLE= 1",
+		"  TLP_ENABLE\t=\t1  ",
+	}
+	want := []KV{{"TLP_ENABLE", "1"}}
+	for _, line := range tests {
+		if got := settings(t, &Parser{}, line+"\n"); !slices.Equal(got, want) {
+			t.Errorf("%q: got %q, want %q", line, got, want)
+		}
+	}
+
+	lines, err := Parse(strings.NewReader("TLP_ENABLE = 1\nDISK_DEVICES = \"nvme0n1 sda\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := Merge(lines, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "TLP_ENABLE=1\nDISK_DEVICES=\"nvme0n1 sda\"\n"; config != want {
+		t.Errorf("Merge() = %q, want %q", config, want)
+	}
+}
+
+func TestParseVariables(t *testing.T) {
+	env := map[string]string{"my_var": "wlan0", "WIFI_BAT": "off"}
+	p := &Parser{
+		LookupEnv: func(name string) (string, bool) {
+			v, ok := env[name]
+			return v, ok
+		},
+		Hostname: "laptop",
+	}
+	text := "DEVICES_TO_DISABLE_ON_STARTUP=${my_var}\n" +
+		"WIFI_PWR_ON_BAT=${WIFI_BAT:-on}\n" +
+		"[ac]\n" +
+		"TLP_PERSISTENT_DEFAULT=${unset_var:-0}\n" +
+		"LOG_TAG=${profile}-${hostname}\n"
+	want := []KV{
+		{"DEVICES_TO_DISABLE_ON_STARTUP", "wlan0"},
+		{"WIFI_PWR_ON_BAT", "off"},
+		{"TLP_PERSISTENT_DEFAULT", "0"},
+		{"LOG_TAG", "ac-laptop"},
+	}
+	if got := settings(t, p, text); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, line := range []string{"X=${unset_var}", "X=${profile:-x}"} {
+		if _, err := p.Parse(strings.NewReader(line + "\n")); err == nil {
+			t.Errorf("%s: no error", line)
+		}
+	}
+}
+
+func TestParseBOM(t *testing.T) {
+	text := "\uFEFF[default]\nTLP_ENABLE=1\n[ac]\nTLP_ENABLE=0\n"
+	lines, err := Parse(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := Profiles(lines), []string{DefaultProfile, "ac"}; !slices.Equal(got, want) {
+		t.Errorf("Profiles() = %q, want %q", got, want)
+	}
+	want := []SectionLine{
+		{Profile: DefaultProfile, Setting: KV{"TLP_ENABLE", "1"}, LineNum: 2},
+		{Profile: "ac", Setting: KV{"TLP_ENABLE", "0"}, LineNum: 4},
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("got %+v, want %+v", lines, want)
+	}
+}
+
+func TestParseIncludeInSection(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"template.txt": "TLP_ENABLE=1\n[ac]\ninclude ac.txt\nCPU_BOOST_ON_AC=1\n",
+		"ac.txt":       "CPU_SCALING_GOVERNOR_ON_AC=performance\n[bat]\nCPU_BOOST_ON_BAT=0\n",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, err := (&Parser{}).ParseFile(filepath.Join(dir, "template.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, sl := range lines {
+		got = append(got, sl.Profile+" "+sl.Setting.Key)
+	}
+	want := []string{
+		"default TLP_ENABLE",
+		"ac CPU_SCALING_GOVERNOR_ON_AC",
+		"bat CPU_BOOST_ON_BAT",
+		"ac CPU_BOOST_ON_AC",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseAllErrorsMalformedSection(t *testing.T) {
+	text := "[ac]\nTLP_ENABLE=1\n[a c]\nTLP_ENABLE=0\n[bat]\nTLP_ENABLE=1\n"
+	_, err := (&Parser{AllErrors: true, Strict: true}).Parse(strings.NewReader(text))
+	var le *LineError
+	if !errors.As(err, &le) || le.Line != 3 || strings.Contains(err.Error(), "\n") {
+		t.Errorf("error = %v, want only the one of line 3", err)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2024, amanofbits
+
+// Package tcprofiles parses tlp config templates with profiles and merges
+// selected profiles into a single set of tlp settings.
+//
+// A template is a tlp config with added ini-like sections, each of them
+// defining a profile. Settings before the first section belong to the
+// default profile, which is always applied first.
+package tcprofiles
+
+import (
+	"slices"
+	"strings"
+)
+
+// DefaultProfile is the name of the profile which is always applied first,
+// unless Parser.DefaultName and Merger.DefaultName name it differently for
+// templates calling their baseline e.g. "base".
+const DefaultProfile = "default"
+
+// KV is a single tlp setting.
+type KV struct {
+	Key, Value string
+}
+
+// SectionLine is a meaningful template line within a profile section: either
+// a setting, removal of a setting, or a directive like 'extends'.
+type SectionLine struct {
+	Profile string
+	Setting KV
+	Extends string // parent profile, set only for 'extends' directive lines
+	Unset   bool   // Setting.Key is removed from accumulated settings
+	Append  bool   // Setting.Value entries are appended to the accumulated list value
+	Raw     bool   // Setting.Value is taken verbatim from a line of a 'raw' key
+	Alias   string // aliased profile, set only for alias definitions, Profile holds the alias name
+	Host    string // host the profile is restricted to, set only for 'host' directive lines
+	Group   string // group member, set only for group definitions, Profile holds the group name
+	// Description describes the profile, set only for '# description:'
+	// comment lines.
+	Description string
+	// Comment holds comment lines immediately preceding a setting, including
+	// ones before the header of its section if it is the first in section.
+	Comment string
+	File    string // template file the line comes from, if known
+	LineNum int
+}
+
+// ConfigValue returns value of setting as it is written to tlp config:
+// verbatim for raw values, quoted if needed otherwise.
+func (sl SectionLine) ConfigValue() string {
+	if sl.Raw {
+		return sl.Setting.Value
+	}
+	return QuoteValue(sl.Setting.Value)
+}
+
+// IsSetting reports whether sl sets or unsets a key, as opposed to
+// directives.
+func (sl SectionLine) IsSetting() bool {
+	return sl.Extends == "" && sl.Alias == "" && sl.Host == "" && sl.Group == "" && sl.Description == ""
+}
+
+// Descriptions maps profiles to their descriptions. Several description lines
+// of a profile are joined with spaces.
+func Descriptions(lines []SectionLine) map[string]string {
+	descriptions := make(map[string]string)
+	for _, sl := range lines {
+		if sl.Description == "" {
+			continue
+		}
+		if prev, ok := descriptions[sl.Profile]; ok {
+			descriptions[sl.Profile] = prev + " " + sl.Description
+		} else {
+			descriptions[sl.Profile] = sl.Description
+		}
+	}
+	return descriptions
+}
+
+// Aliases maps alias names defined in lines to profiles they stand for.
+func Aliases(lines []SectionLine) map[string]string {
+	aliases := make(map[string]string)
+	for _, sl := range lines {
+		if sl.Alias != "" {
+			aliases[sl.Profile] = sl.Alias
+		}
+	}
+	return aliases
+}
+
+// Groups maps group names defined in lines to their members, in order.
+func Groups(lines []SectionLine) map[string][]string {
+	groups := make(map[string][]string)
+	for _, sl := range lines {
+		if sl.Group != "" {
+			groups[sl.Profile] = append(groups[sl.Profile], sl.Group)
+		}
+	}
+	return groups
+}
+
+// ExpandGroups replaces groups in selected with their members, expanding
+// nested groups too. Groups already being expanded are skipped, though
+// Parser reports such cycles.
+func ExpandGroups(lines []SectionLine, selected []string) []string {
+	groups := Groups(lines)
+	var expand func(names, chain []string) []string
+	expand = func(names, chain []string) []string {
+		var expanded []string
+		for _, p := range names {
+			members, ok := groups[p]
+			switch {
+			case !ok:
+				expanded = append(expanded, p)
+			case slices.Index(chain, p) < 0:
+				expanded = append(expanded, expand(members, append(chain, p))...)
+			}
+		}
+		return expanded
+	}
+	return expand(selected, nil)
+}
+
+// ExpandAliases replaces aliases in selected with profiles they stand for.
+func ExpandAliases(lines []SectionLine, selected []string) []string {
+	aliases := Aliases(lines)
+	expanded := make([]string, len(selected))
+	for i, p := range selected {
+		if target, ok := aliases[p]; ok {
+			p = target
+		}
+		expanded[i] = p
+	}
+	return expanded
+}
+
+// FoldCase calls Merger.FoldCase of zero Merger.
+func FoldCase(lines []SectionLine, selected []string) []string {
+	return Merger{}.FoldCase(lines, selected)
+}
+
+// FoldCase replaces names in selected, which match no profile, alias or group
+// of lines exactly, with the one differing from them only in case. Names
+// matching several of them this way are kept as is.
+func (m Merger) FoldCase(lines []SectionLine, selected []string) []string {
+	names := m.Profiles(lines)
+	for alias := range Aliases(lines) {
+		names = append(names, alias)
+	}
+	for group := range Groups(lines) {
+		names = append(names, group)
+	}
+
+	folded := make([]string, len(selected))
+	for i, p := range selected {
+		folded[i] = p
+		if slices.Index(names, p) >= 0 {
+			continue
+		}
+		match := ""
+		for _, name := range names {
+			if strings.EqualFold(name, p) {
+				if match != "" {
+					match = ""
+					break
+				}
+				match = name
+			}
+		}
+		if match != "" {
+			folded[i] = match
+		}
+	}
+	return folded
+}
+
+// Profiles calls Merger.Profiles of zero Merger.
+func Profiles(lines []SectionLine) []string {
+	return Merger{}.Profiles(lines)
+}
+
+// Profiles returns names of profiles defined in lines, default first and the
+// rest sorted.
+func (m Merger) Profiles(lines []SectionLine) []string {
+	ps := make(map[string]struct{}, 0)
+	for _, sl := range lines {
+		if sl.Alias == "" && sl.Group == "" {
+			ps[sl.Profile] = struct{}{}
+		}
+	}
+
+	delete(ps, m.defaultName())
+
+	var psArr []string
+	for p := range ps {
+		psArr = append(psArr, p)
+	}
+	slices.Sort(psArr)
+
+	return append([]string{m.defaultName()}, psArr...)
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// ParseTOML parses template in TOML format from r. Keys before the first
+// table belong to default profile, each table is a profile, and nested
+// tables are profiles named by their dotted path, e.g. [home.office]. Values
+// are flattened to tlp values: booleans to 1 or 0, numbers to their shortest
+// decimal form, e.g. 0x10 to 16 and 1.50 to 1.5, and arrays to
+// space-separated lists. String keys 'extends', 'host' and 'description' are
+// directives, as in the ini template, 'host' can be an array too. Settings of
+// a profile are sorted by key, as TOML doesn't keep their order. Appends,
+// removals, includes, aliases and groups are not supported in TOML
+// templates. With AllErrors, errors of values are reported without their
+// lines, which TOML decoding doesn't keep.
+func (p *Parser) ParseTOML(r io.Reader) ([]SectionLine, error) {
+	return p.parseTOML(r, "")
+}
+
+// ParseTOMLFile parses TOML template file at path, see ParseTOML.
+func (p *Parser) ParseTOMLFile(path string) ([]SectionLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return p.parseTOML(f, path)
+}
+
+// parseTOML parses TOML template from r, read from file.
+func (p *Parser) parseTOML(r io.Reader, file string) ([]SectionLine, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("template read error: %v", err)
+	}
+	st := &parseState{keys: standardKeys, top: file}
+	if p.ExtendedKeys {
+		st.keys = extendedKeys
+	}
+	var lineErrs []error
+	if p.MaxLineLength > 0 {
+		for i, line := range strings.Split(strings.TrimPrefix(string(data), "\uFEFF"), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if n := utf8.RuneCountInString(line); n > p.MaxLineLength {
+				msg := fmt.Sprintf("%s is %d characters long, more than %d", st.position(file, i+1), n, p.MaxLineLength)
+				if err := p.warn(msg); err != nil {
+					if !p.AllErrors {
+						return nil, &LineError{File: file, Line: i + 1, Err: err}
+					}
+					lineErrs = append(lineErrs, &LineError{File: file, Line: i + 1, Err: err})
+				}
+			}
+		}
+	}
+
+	var doc map[string]any
+	err = toml.Unmarshal(data, &doc)
+	var de *toml.DecodeError
+	if errors.As(err, &de) {
+		row, _ := de.Position()
+		err = &LineError{File: file, Line: row, Err: fmt.Errorf("malformed TOML template line %d: %v", row, de)}
+	} else if err != nil {
+		err = fmt.Errorf("malformed TOML template: %v", err)
+	} else {
+		err = p.parseTable(doc, p.defaultName(), file, st)
+	}
+	if err != nil && len(lineErrs) == 0 {
+		return nil, err
+	}
+	if err := errors.Join(append(lineErrs, err)...); err != nil {
+		return nil, err
+	}
+	return p.finish(st)
+}
+
+// parseTable appends lines of TOML table of profile to st, nested tables are
+// parsed as profiles named by their dotted path. With AllErrors, errors of
+// all values are joined.
+func (p *Parser) parseTable(table map[string]any, profile, file string, st *parseState) error {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var nested []string
+	var errs []error
+	for _, key := range keys {
+		value := table[key]
+		if _, ok := value.(map[string]any); ok {
+			nested = append(nested, key)
+			continue
+		}
+		if err := p.parseTOMLValue(profile, key, value, file, st); err != nil {
+			if !p.AllErrors {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	for _, key := range nested {
+		name := key
+		if profile != p.defaultName() {
+			name = profile + "." + key
+		}
+		err := fmt.Errorf("malformed profile name %q in TOML template", name)
+		if validSectionNameRegex.MatchString(name) {
+			err = p.parseTable(table[key].(map[string]any), name, file, st)
+		}
+		if err != nil {
+			if !p.AllErrors {
+				return err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseTOMLValue appends line of key set to value in TOML table of profile
+// to st.
+func (p *Parser) parseTOMLValue(profile, key string, value any, file string, st *parseState) error {
+	switch key {
+	case "extends", "host", "description":
+		var values []string
+		switch v := value.(type) {
+		case string:
+			values = []string{v}
+		case []any:
+			if key != "host" {
+				return fmt.Errorf("%s of profile %q must be a string", key, profile)
+			}
+			for _, e := range v {
+				s, ok := e.(string)
+				if !ok {
+					return fmt.Errorf("host of profile %q must be a string or an array of strings", profile)
+				}
+				values = append(values, s)
+			}
+		default:
+			return fmt.Errorf("%s of profile %q must be a string", key, profile)
+		}
+		for _, v := range values {
+			sl := SectionLine{Profile: profile, File: file}
+			switch {
+			case key == "description":
+				sl.Description = v
+			case profile == p.defaultName():
+				return fmt.Errorf("default profile can't have %s", key)
+			case key == "extends" && !validSectionNameRegex.MatchString(v):
+				return fmt.Errorf("malformed profile name %q in extends of profile %q", v, profile)
+			case key == "extends":
+				sl.Extends = v
+			case strings.TrimSpace(v) == "":
+				return fmt.Errorf("empty host name in profile %q", profile)
+			default:
+				sl.Host = strings.TrimSpace(v)
+			}
+			st.lines = append(st.lines, sl)
+		}
+		return nil
+	}
+
+	if !st.keys.keyVal.MatchString(key + "=x") {
+		return fmt.Errorf("malformed key %q in profile %q of TOML template", key, profile)
+	}
+	text, err := tomlValue(value)
+	if err != nil {
+		return fmt.Errorf("%s in profile %q: %v", key, profile, err)
+	}
+	if p.LookupEnv != nil {
+		if text, err = p.expandEnv(text, profile); err != nil {
+			return fmt.Errorf("%s in profile %q: %v", key, profile, err)
+		}
+	}
+
+	if replacement, ok := ReplacementKey(key); ok {
+		msg := fmt.Sprintf("deprecated key %s in profile %q, use %s instead", key, profile, replacement)
+		if err := p.warn(msg); err != nil {
+			return err
+		}
+	} else if p.CheckKeys && !KnownKey(key) {
+		msg := fmt.Sprintf("unknown key %s in profile %q", key, profile)
+		if suggestion := SuggestKey(key); suggestion != "" {
+			msg += fmt.Sprintf(", did you mean %s?", suggestion)
+		}
+		if err := p.warn(msg); err != nil {
+			return err
+		}
+	}
+	if p.CheckValues {
+		if err := CheckValue(key, text); err != nil {
+			if err := p.warn(fmt.Sprintf("%v (profile %q)", err, profile)); err != nil {
+				return err
+			}
+		}
+	}
+	st.lines = append(st.lines, SectionLine{Profile: profile, Setting: KV{Key: key, Value: text}, File: file})
+	return nil
+}
+
+// tomlValue returns tlp value of decoded TOML value.
+func tomlValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		entries := make([]string, 0, len(v))
+		for _, e := range v {
+			if _, ok := e.([]any); ok {
+				return "", errors.New("nested arrays are not supported")
+			}
+			s, err := tomlValue(e)
+			if err != nil {
+				return "", err
+			}
+			entries = append(entries, s)
+		}
+		return strings.Join(entries, " "), nil
+	default:
+		return "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
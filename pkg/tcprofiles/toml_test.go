@@ -0,0 +1,72 @@
+// Copyright (c) 2024, amanofbits
+
+package tcprofiles
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseTOMLValues(t *testing.T) {
+	text := "TLP_ENABLE = true\n" +
+		"CPU_MAX_PERF_ON_AC = 0x10\n" +
+		"CPU_BOOST_ON_AC = 1.50\n" +
+		"PLATFORM_PROFILE_ON_AC = \"1.50\"\n" +
+		"USB_DENYLIST = [\"1111:2222\", \"3333:4444\"]\n"
+	lines, err := (&Parser{}).ParseTOML(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []KV
+	for _, sl := range lines {
+		got = append(got, sl.Setting)
+	}
+	want := []KV{
+		{"CPU_BOOST_ON_AC", "1.5"},
+		{"CPU_MAX_PERF_ON_AC", "16"},
+		{"PLATFORM_PROFILE_ON_AC", "1.50"},
+		{"TLP_ENABLE", "1"},
+		{"USB_DENYLIST", "1111:2222 3333:4444"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseTOMLMaxLineLength(t *testing.T) {
+	text := "TLP_ENABLE = 1\n[ac]\nUSB_DENYLIST = \"1111:2222 3333:4444\"\n"
+	var warnings []string
+	p := &Parser{MaxLineLength: 20, Warn: func(msg string) { warnings = append(warnings, msg) }}
+	if _, err := p.ParseTOML(strings.NewReader(text)); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "line 3 ") {
+		t.Errorf("warnings = %q, want one about line 3", warnings)
+	}
+
+	p = &Parser{MaxLineLength: 20, Strict: true}
+	_, err := p.ParseTOML(strings.NewReader(text))
+	var le *LineError
+	if !errors.As(err, &le) || le.Line != 3 {
+		t.Errorf("error = %v, want one of line 3", err)
+	}
+}
+
+func TestParseTOMLAllErrors(t *testing.T) {
+	text := "extends = \"ac\"\nTLP_ENABLE = 1\n[ac]\nhost = 1\n[bat]\nUSB_DENYLIST = [[\"1111:2222\"]]\n"
+	_, err := (&Parser{AllErrors: true}).ParseTOML(strings.NewReader(text))
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, want := range []string{"default profile can't have extends", `host of profile "ac"`, "nested arrays"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't report %q", err, want)
+		}
+	}
+
+	if _, err := (&Parser{}).ParseTOML(strings.NewReader(text)); err == nil || strings.Contains(err.Error(), "\n") {
+		t.Errorf("error = %v, want only the first one", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// onACPower reports whether any non-battery power supply is online.
+func onACPower() (bool, error) {
+	entries, err := os.ReadDir(powerSupplyDir)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	for _, e := range entries {
+		dir := filepath.Join(powerSupplyDir, e.Name())
+		typ, err := os.ReadFile(filepath.Join(dir, "type"))
+		if err != nil || strings.TrimSpace(string(typ)) == "Battery" {
+			continue
+		}
+		online, err := os.ReadFile(filepath.Join(dir, "online"))
+		if err != nil {
+			continue
+		}
+		found = true
+		if strings.TrimSpace(string(online)) == "1" {
+			return true, nil
+		}
+	}
+	if !found {
+		return false, errors.New("no AC power supply found")
+	}
+	return false, nil
+}
+
+// autoProfile picks AC or battery profile from "<ac_profile>,<bat_profile>"
+// spec depending on current power source. Falls back to AC profile if power
+// source can't be detected.
+func autoProfile(spec string) (string, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("-auto expects two comma-separated profiles <ac_profile>,<bat_profile>, got %q", spec)
+	}
+
+	ac, err := onACPower()
+	if err != nil {
+		logWarning("can't detect power source (%v), using profile %s\n", err, parts[0])
+		return parts[0], nil
+	}
+	if ac {
+		logInfo("AC power detected, using profile %s\n", parts[0])
+		return parts[0], nil
+	}
+	logInfo("Battery power detected, using profile %s\n", parts[1])
+	return parts[1], nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import "github.com/amanofbits/tcprofiles/pkg/tcprofiles"
+
+// showProfile prints effective settings of profile merged with default
+// profile, without header or other messages.
+func showProfile(profile string) {
+	lines, profiles := loadTemplate()
+	selected := lookupProfiles(lines, profiles, []string{profile})
+	lines = filterHost(lines, selected)
+	printSettings(lines, selected)
+}
+
+// dumpAll prints effective settings of each profile merged with default
+// profile, under a banner with profile name. Host restrictions are ignored,
+// so that profiles are shown as they are on their hosts.
+func dumpAll() {
+	lines, profiles := loadTemplate()
+	for i, p := range profiles {
+		if i > 0 {
+			logToOut("\n")
+		}
+		logToOut("### %s ###\n", p)
+		printSettings(lines, []string{p})
+	}
+}
+
+// printSettings prints merged settings of selected profiles.
+func printSettings(lines []tcprofiles.SectionLine, selected []string) {
+	for _, sl := range merger().Resolve(lines, selected) {
+		logToOut("%s=%s\n", sl.Setting.Key, sl.ConfigValue())
+	}
+}
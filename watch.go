@@ -0,0 +1,100 @@
+// Copyright (c) 2024, amanofbits
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/amanofbits/tcprofiles/pkg/tcprofiles"
+)
+
+// watchInterval is how often template files are checked for changes.
+const watchInterval = 500 * time.Millisecond
+
+// watchTemplate runs the tool with the same arguments, except -watch, each
+// time template files change, until interrupted. Errors of a run are shown,
+// but don't stop watching. The screen is cleared before each run if STDOUT is
+// a terminal.
+func watchTemplate() error {
+	if *templatePath == "-" && *templateDir == "" {
+		return errors.New("-watch can't be used with template read from STDIN")
+	}
+	if remoteTemplate() {
+		return errors.New("-watch can't be used with template read from URL")
+	}
+	if *interactive {
+		return errors.New("-watch can't be used with -interactive")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	for _, arg := range os.Args[1:] {
+		name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "watch" {
+			args = append(args, arg)
+		}
+	}
+	fi, err := os.Stdout.Stat()
+	clearScreen := err == nil && fi.Mode()&os.ModeCharDevice != 0
+
+	state := ""
+	for {
+		if s := watchState(); s != state {
+			state = s
+			if clearScreen {
+				fmt.Fprint(os.Stdout, "\033[H\033[2J")
+			}
+			cmd := exec.Command(exe, args...)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+			if err := cmd.Run(); err != nil {
+				var exitErr *exec.ExitError
+				if !errors.As(err, &exitErr) {
+					return err
+				}
+			}
+			logInfo("Watching %s for changes, press Ctrl+C to stop\n", templateName())
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// watchState returns modification times and sizes of template files,
+// including included ones, which changes if any of them changes.
+func watchState() string {
+	files := []string{*templatePath}
+	if *templateDir != "" {
+		files, _ = filepath.Glob(filepath.Join(*templateDir, "*.txt"))
+	}
+	// Included files are only known if template parses.
+	parser := tcprofiles.Parser{AllowWhitespace: *allowTabs, ExtendedKeys: *extendedKeys, DefaultName: *defaultName}
+	var lines []tcprofiles.SectionLine
+	if *templateDir != "" {
+		lines, _ = parser.ParseFiles(files...)
+	} else {
+		lines, _ = parser.ParseFile(*templatePath)
+	}
+	for _, sl := range lines {
+		if slices.Index(files, sl.File) < 0 {
+			files = append(files, sl.File)
+		}
+	}
+
+	sb := strings.Builder{}
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&sb, "%s %v %d\n", f, fi.ModTime(), fi.Size())
+		} else {
+			fmt.Fprintf(&sb, "%s %v\n", f, err)
+		}
+	}
+	return sb.String()
+}